@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// batchUploader sends a group of probes somewhere and reports how many from the front of the
+// slice it's done with, the rest are worth trying again.
+type batchUploader func([]Probe) (int, error)
+
+// ResultBatcher collects probes in memory and hands them off once batchSize have built up or
+// the oldest one has waited window, whichever comes first. Used when results aren't spooled.
+type ResultBatcher struct {
+	lock      sync.Mutex
+	pending   []Probe
+	timer     *time.Timer
+	batchSize int
+	window    time.Duration
+	upload    batchUploader
+}
+
+func NewResultBatcher(batchSize int, window time.Duration, upload batchUploader) *ResultBatcher {
+	return &ResultBatcher{
+		pending:   make([]Probe, 0, batchSize),
+		batchSize: batchSize,
+		window:    window,
+		upload:    upload,
+	}
+}
+
+func (b *ResultBatcher) Emit(probe Probe) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.pending = append(b.pending, probe)
+	if len(b.pending) >= b.batchSize || b.window <= 0 {
+		b.flushLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.Flush)
+	}
+}
+
+// Flush sends whatever is pending right away
+func (b *ResultBatcher) Flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flushLocked()
+}
+
+func (b *ResultBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+
+	batch := b.pending
+	b.pending = make([]Probe, 0, b.batchSize)
+	go func() {
+		// Nothing to fall back on without a spool, whatever didn't make it is gone
+		done, uploadErr := b.upload(batch)
+		if uploadErr != nil {
+			log.Warn(fmt.Sprintf("Dropping %d probe results: %s", len(batch)-done, uploadErr))
+		}
+	}()
+}
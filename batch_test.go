@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withTestServer points uploads at handler for the length of the test
+func withTestServer(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewTLSServer(handler)
+	previousClient, previousServer := httpClient, voyagerServer
+	httpClient = server.Client()
+	voyagerServer = strings.TrimPrefix(server.URL, "https://")
+	batchRejectedAt = 0
+	t.Cleanup(func() {
+		server.Close()
+		httpClient, voyagerServer = previousClient, previousServer
+		batchRejectedAt = 0
+	})
+}
+
+func TestUploadProbeBatchGzip(t *testing.T) {
+	assert := assert.New(t)
+	var received []Probe
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("gzip", r.Header.Get("Content-Encoding"))
+		reader, gzipErr := gzip.NewReader(r.Body)
+		assert.Nil(gzipErr)
+		assert.Nil(json.NewDecoder(reader).Decode(&received))
+		w.WriteHeader(201)
+	})
+
+	done, uploadErr := uploadProbeBatch([]Probe{{Target: "192.0.2.1"}, {Target: "192.0.2.2"}})
+	assert.Nil(uploadErr)
+	assert.Equal(2, done)
+	assert.Equal(2, len(received), "sent as one array")
+}
+
+func TestUploadProbeBatchFallback(t *testing.T) {
+	assert := assert.New(t)
+	var lock sync.Mutex
+	singles := 0
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			w.WriteHeader(400)
+			return
+		}
+		lock.Lock()
+		singles++
+		lock.Unlock()
+		w.WriteHeader(201)
+		w.Write([]byte(`{"id": 1}`))
+	})
+
+	done, uploadErr := uploadProbeBatch([]Probe{{Target: "192.0.2.1"}, {Target: "192.0.2.2"}})
+	assert.Nil(uploadErr)
+	assert.Equal(2, done)
+	assert.Equal(2, singles, "fell back to a POST per result")
+	assert.NotEqual(int64(0), batchRejectedAt, "batches skipped for a while")
+}
+
+func TestUploadProbeBatchRetryable(t *testing.T) {
+	assert := assert.New(t)
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	})
+
+	done, uploadErr := uploadProbeBatch([]Probe{{Target: "192.0.2.1"}, {Target: "192.0.2.2"}})
+	assert.Error(uploadErr)
+	assert.Equal(0, done, "nothing done, all of it retried later")
+}
+
+func TestUploadProbeBatchRejectedDoesNotStallSpool(t *testing.T) {
+	assert := assert.New(t)
+	var lock sync.Mutex
+	singles := 0
+	withTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			lock.Lock()
+			singles++
+			lock.Unlock()
+		}
+		w.WriteHeader(422)
+	})
+
+	spool := newTestSpool(t, 0, uploadProbeBatch)
+	spool.Emit(Probe{Target: "192.0.2.1"})
+	spool.Emit(Probe{Target: "192.0.2.2"})
+
+	assert.Nil(spool.send(spool.entries()), "rejected results aren't an outage")
+	assert.Equal(0, len(spool.entries()), "rejected results dropped, spool moves on")
+	assert.Equal(2, singles, "each result tried on its own")
+	assert.Equal(int64(0), batchRejectedAt, "server still takes batches")
+}
+
+func TestResultBatcherFlushesOnSize(t *testing.T) {
+	assert := assert.New(t)
+	batches := make(chan []Probe, 2)
+	batcher := NewResultBatcher(2, time.Hour, func(probes []Probe) (int, error) {
+		batches <- probes
+		return len(probes), nil
+	})
+
+	batcher.Emit(Probe{Target: "192.0.2.1"})
+	batcher.Emit(Probe{Target: "192.0.2.2"})
+	select {
+	case batch := <-batches:
+		assert.Equal(2, len(batch))
+	case <-time.After(time.Second):
+		t.Fatal("full batch not sent")
+	}
+}
+
+func TestResultBatcherFlushesOnWindow(t *testing.T) {
+	assert := assert.New(t)
+	batches := make(chan []Probe, 2)
+	batcher := NewResultBatcher(10, 20*time.Millisecond, func(probes []Probe) (int, error) {
+		batches <- probes
+		return len(probes), nil
+	})
+
+	batcher.Emit(Probe{Target: "192.0.2.1"})
+	select {
+	case batch := <-batches:
+		assert.Equal(1, len(batch))
+	case <-time.After(time.Second):
+		t.Fatal("partial batch not sent after window")
+	}
+}
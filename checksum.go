@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// pseudoHeader builds the pseudo header TCP and UDP checksums are computed over. IPv6 uses
+// a 32 bit length and pads out the next header field, IPv4 is the classic 12 byte layout.
+func pseudoHeader(src, dst net.IP, proto byte, length int) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header := make([]byte, 0, 12)
+		header = append(header, src4...)
+		header = append(header, dst4...)
+		header = append(header, 0, proto, byte(length>>8), byte(length))
+		return header
+	}
+
+	header := make([]byte, 0, 40)
+	header = append(header, src.To16()...)
+	header = append(header, dst.To16()...)
+	header = append(header, 0, 0, byte(length>>8), byte(length))
+	header = append(header, 0, 0, 0, proto)
+	return header
+}
+
+func onesComplementChecksum(pseudoHeader, data []byte) uint16 {
+	sumThis := make([]byte, 0, len(pseudoHeader)+len(data))
+	sumThis = append(sumThis, pseudoHeader...)
+	sumThis = append(sumThis, data...)
+
+	lenSumThis := len(sumThis)
+	var nextWord uint16
+	var sum uint32
+	for i := 0; i+1 < lenSumThis; i += 2 {
+		nextWord = uint16(sumThis[i])<<8 | uint16(sumThis[i+1])
+		sum += uint32(nextWord)
+
+	}
+	if lenSumThis%2 != 0 {
+		//fmt.Println("Odd byte")
+		sum += uint32(sumThis[len(sumThis)-1])
+
+	}
+
+	// Add back any carry, and any carry from adding the carry
+	sum = (sum >> 16) + (sum & 0xffff)
+	sum = sum + (sum >> 16)
+
+	// Bitwise complement
+	return uint16(^sum)
+
+}
+
+// craftUDPDatagram builds a UDP datagram whose checksum is id. The checksum is quoted back
+// to us in ICMP errors, so it doubles as a probe identifier without touching the ports. A 2
+// byte payload is picked so the checksum still verifies at the destination.
+func craftUDPDatagram(src, dst net.IP, srcPort, dstPort uint16, id uint16) []byte {
+	return craftPaddedUDPDatagram(src, dst, srcPort, dstPort, id, 10)
+}
+
+// craftPaddedUDPDatagram is craftUDPDatagram padded out with zeroes to length bytes, which
+// leaves the checksum alone. Anything under 10 bytes gets the usual 10.
+func craftPaddedUDPDatagram(src, dst net.IP, srcPort, dstPort uint16, id uint16, length int) []byte {
+	if length < 10 {
+		length = 10
+	}
+	datagram := make([]byte, length)
+	binary.BigEndian.PutUint16(datagram[0:2], srcPort)
+	binary.BigEndian.PutUint16(datagram[2:4], dstPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+
+	// With a zeroed payload the checksum works out to ~S where S is the one's complement sum of
+	// everything else. We need S + P to come out to ~id, so P = ~id - S, which in one's
+	// complement arithmetic is ~id + ~S.
+	zeroChecksum := onesComplementChecksum(pseudoHeader(src, dst, protocolUDP, len(datagram)), datagram)
+	sum := uint32(^id) + uint32(zeroChecksum)
+	sum = (sum >> 16) + (sum & 0xffff)
+
+	binary.BigEndian.PutUint16(datagram[6:8], id)
+	binary.BigEndian.PutUint16(datagram[8:10], uint16(sum))
+	return datagram
+}
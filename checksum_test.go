@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestCraftUDPDatagram(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, pair := range [][2]string{{"192.0.2.2", "198.51.100.7"}, {"2001:db8::2", "2001:db8:1::7"}} {
+		src, dst := net.ParseIP(pair[0]), net.ParseIP(pair[1])
+		for _, id := range []uint16{1, 4242, 0xfffe} {
+			datagram := craftUDPDatagram(src, dst, 40000, 33434, id)
+
+			assert.Equal(id, binary.BigEndian.Uint16(datagram[6:8]), "checksum field carries probe id")
+
+			// Summing a datagram that carries a valid checksum comes out to zero
+			verify := onesComplementChecksum(pseudoHeader(src, dst, protocolUDP, len(datagram)), datagram)
+			assert.Equal(uint16(0), verify, "checksum verifies for %s id %d", dst, id)
+		}
+
+		for _, length := range []int{1472, 1231} {
+			datagram := craftPaddedUDPDatagram(src, dst, 40000, 33434, 4242, length)
+			assert.Equal(length, len(datagram))
+			assert.Equal(uint16(length), binary.BigEndian.Uint16(datagram[4:6]))
+			verify := onesComplementChecksum(pseudoHeader(src, dst, protocolUDP, len(datagram)), datagram)
+			assert.Equal(uint16(0), verify, "padded checksum verifies for %s length %d", dst, length)
+		}
+	}
+}
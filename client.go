@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -9,11 +10,26 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 const pageSize int = 100
 
+const (
+	BATCH_DEFAULT_SIZE   = 50
+	BATCH_DEFAULT_WINDOW = 10 * time.Second
+	BATCH_RETRY_INTERVAL = time.Hour
+)
+
+// Shared by everything talking to voyager server so connections are kept alive and reused
+// instead of paying for a TLS handshake on every request.
+var httpClient = &http.Client{Timeout: time.Second * 10}
+
+// When voyager server turns down a batch we go back to one POST per result for a while
+// before trying batches again. Unix nanos, 0 means batches are fine.
+var batchRejectedAt int64
+
 type DRFResponse struct {
 	Count    uint          `json:"count"`
 	Next     string        `json:"next"`
@@ -22,15 +38,63 @@ type DRFResponse struct {
 }
 
 type ProbeTarget struct {
-	Destination string `json:"destination"`
-	Interval    uint   `json:"interval"`
-	ProbeCount  int    `json:"probe_count"`
-	Type        string `json:"type"`
-	Port        uint16 `json:"port"`
+	Destination   string  `json:"destination" yaml:"destination"`
+	Interval      uint    `json:"interval" yaml:"interval"`
+	ProbeCount    int     `json:"probe_count" yaml:"probe_count"`
+	Type          string  `json:"type" yaml:"type"`
+	Port          uint16  `json:"port" yaml:"port"`
+	AddressFamily string  `json:"address_family" yaml:"address_family"`
+	Paris         bool    `json:"paris" yaml:"paris"`
+	MDA           bool    `json:"mda" yaml:"mda"`
+	MDAConfidence float64 `json:"mda_confidence" yaml:"mda_confidence"`
+	Continuous    bool    `json:"continuous" yaml:"continuous"`
+	CycleMS       uint    `json:"cycle_ms" yaml:"cycle_ms"`
+	Window        int     `json:"window" yaml:"window"`
+
+	IgnoreSilentHops bool `json:"ignore_silent_hops" yaml:"ignore_silent_hops"`
+	MaxHops          int  `json:"max_hops" yaml:"max_hops"`
+	DisableRDNS      bool `json:"disable_rdns" yaml:"disable_rdns"`
+	AllAddresses     bool `json:"all_addresses" yaml:"all_addresses"`
+	AddressIndex     int  `json:"address_index" yaml:"address_index"`
+	DSCP             int  `json:"dscp" yaml:"dscp"`
+	ECN              int  `json:"ecn" yaml:"ecn"`
+}
+
+// maxHops is the highest TTL probes to this target go out with
+func (t ProbeTarget) maxHops() int {
+	if t.MaxHops > 0 {
+		return t.MaxHops
+	}
+	return MAX_HOPS
+}
+
+// tos is the TOS byte, or IPv6 traffic class, probes to this target go out with
+func (t ProbeTarget) tos() int {
+	return t.DSCP<<2 | t.ECN&0x03
+}
+
+// validate checks everything about the target that would have it probed wrong or not at all,
+// whether it came from voyager server or a targets file
+func (t ProbeTarget) validate() error {
+	if _, ok := probeTypeMap[t.Type]; !ok {
+		return fmt.Errorf("unsupported type for %s: %s", t.Destination, t.Type)
+	}
+	if t.Continuous && !continuousSupported(t) {
+		return fmt.Errorf("continuous mode is not supported for %s probes: %s", t.Type, t.Destination)
+	}
+	if t.DSCP < 0 || t.DSCP > 63 {
+		return fmt.Errorf("invalid dscp for %s: %d", t.Destination, t.DSCP)
+	}
+	if t.ECN < 0 || t.ECN > 3 {
+		return fmt.Errorf("invalid ecn for %s: %d", t.Destination, t.ECN)
+	}
+	if t.AddressIndex < 0 {
+		return fmt.Errorf("invalid address_index for %s: %d", t.Destination, t.AddressIndex)
+	}
+	return nil
 }
 
 func getProbeTargets() ([]ProbeTarget, error) {
-	client := &http.Client{Timeout: time.Second * 10}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s/api/v1/probe-targets/", voyagerServer), nil)
 	req.Header.Add("Authorization", fmt.Sprintf("Token %s", proberToken))
 
@@ -45,13 +109,14 @@ func getProbeTargets() ([]ProbeTarget, error) {
 		q.Set("offset", strconv.Itoa(currentOffset))
 		req.URL.RawQuery = q.Encode()
 
-		resp, requestErr := client.Do(req)
+		resp, requestErr := httpClient.Do(req)
 		if requestErr != nil {
 			log.Warn(requestErr)
 			return nil, requestErr
 		}
 
 		body, bodyErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if bodyErr != nil {
 			log.Warn(bodyErr)
 			return nil, bodyErr
@@ -78,30 +143,129 @@ func getProbeTargets() ([]ProbeTarget, error) {
 	return targetArray, nil
 }
 
-func emitProbeResults(probe Probe) {
+// RejectedError is a response from voyager server saying it will never accept a result, as
+// opposed to an outage. Retrying those is pointless.
+type RejectedError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("probe result rejected: [HTTP%d] %s", e.StatusCode, e.Body)
+}
+
+func emitProbeResults(probe Probe) error {
 	payload, jsonErr := json.Marshal(probe)
 	if jsonErr != nil {
-		log.Warn("Error creating probe result payload: ", jsonErr)
+		return fmt.Errorf("Error creating probe result payload: %s", jsonErr)
 	}
 
-	client := &http.Client{Timeout: time.Second * 10}
 	req, _ := http.NewRequest("POST", fmt.Sprintf("https://%s/api/v1/probe-results/", voyagerServer), bytes.NewBuffer(payload))
 	req.Header.Add("Authorization", fmt.Sprintf("Token %s", proberToken))
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, requestErr := client.Do(req)
+	resp, requestErr := httpClient.Do(req)
 	if requestErr != nil {
-		log.Warn(requestErr)
-		return
+		atomic.AddUint64(&uploadFailures, 1)
+		return requestErr
 	}
+	defer resp.Body.Close()
 
 	// yea it's kinda dirty but we only want the ID back so whatever
 	jsonBody := make(map[string]interface{})
 	respBody, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 201 {
-		log.Warn(fmt.Sprintf("POST of probe results failed: [HTTP%d] %s\n", resp.StatusCode, string(respBody)))
-	} else {
-		json.Unmarshal(respBody, &jsonBody)
-		log.Info(fmt.Sprintf("Published probe result: %+v", jsonBody["id"]))
+		atomic.AddUint64(&uploadFailures, 1)
+		return uploadError(resp.StatusCode, respBody)
+	}
+
+	json.Unmarshal(respBody, &jsonBody)
+	log.Info(fmt.Sprintf("Published probe result: %+v", jsonBody["id"]))
+	return nil
+}
+
+// uploadError sorts a failed upload into one worth retrying or a RejectedError. Server side
+// trouble, rate limiting, timeouts and auth problems can all fix themselves, anything else
+// the server didn't like about the result itself will be the same next time.
+func uploadError(statusCode int, body []byte) error {
+	switch {
+	case statusCode >= 500, statusCode == 401, statusCode == 403, statusCode == 404,
+		statusCode == 408, statusCode == 429:
+		return fmt.Errorf("POST of probe results failed: [HTTP%d] %s", statusCode, string(body))
+	}
+	return &RejectedError{StatusCode: statusCode, Body: string(body)}
+}
+
+// uploadProbeBatch sends probes to voyager server as a single gzipped JSON array. If the
+// server doesn't take batches, it falls back to a POST per result. The count returned is how
+// many probes from the front of the slice are done with, uploaded or rejected for good. The
+// rest should be tried again later.
+func uploadProbeBatch(probes []Probe) (int, error) {
+	rejectedAt := atomic.LoadInt64(&batchRejectedAt)
+	if len(probes) == 1 || (rejectedAt != 0 && time.Since(time.Unix(0, rejectedAt)) < BATCH_RETRY_INTERVAL) {
+		return uploadEachProbe(probes)
+	}
+
+	payload, encodeErr := gzipJSON(probes)
+	if encodeErr != nil {
+		return 0, encodeErr
+	}
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf("https://%s/api/v1/probe-results/", voyagerServer), bytes.NewReader(payload))
+	req.Header.Add("Authorization", fmt.Sprintf("Token %s", proberToken))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Encoding", "gzip")
+
+	resp, requestErr := httpClient.Do(req)
+	if requestErr != nil {
+		atomic.AddUint64(&uploadFailures, 1)
+		return 0, requestErr
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case 200, 201:
+		atomic.StoreInt64(&batchRejectedAt, 0)
+		log.Info(fmt.Sprintf("Published batch of %d probe results", len(probes)))
+		return len(probes), nil
+	case 400, 404, 405, 413, 415:
+		log.Warn(fmt.Sprintf("Batch upload not accepted, falling back to single results: [HTTP%d] %s", resp.StatusCode, string(respBody)))
+		atomic.StoreInt64(&batchRejectedAt, time.Now().UnixNano())
+		return uploadEachProbe(probes)
+	}
+
+	atomic.AddUint64(&uploadFailures, 1)
+	batchErr := uploadError(resp.StatusCode, respBody)
+	if _, ok := batchErr.(*RejectedError); ok {
+		// Something in the batch won't ever be taken, one at a time the rest still can be
+		log.Warn(fmt.Sprintf("Batch upload rejected, sending results one at a time: %s", batchErr))
+		return uploadEachProbe(probes)
+	}
+	return 0, batchErr
+}
+
+// uploadEachProbe posts probes one at a time, stopping at the first one worth retrying
+func uploadEachProbe(probes []Probe) (int, error) {
+	for i, probe := range probes {
+		uploadErr := emitProbeResults(probe)
+		if rejected, ok := uploadErr.(*RejectedError); ok {
+			log.Warn(fmt.Sprintf("Dropping probe result for %s: %s", probe.Target, rejected))
+		} else if uploadErr != nil {
+			return i, uploadErr
+		}
+	}
+	return len(probes), nil
+}
+
+func gzipJSON(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if encodeErr := json.NewEncoder(writer).Encode(value); encodeErr != nil {
+		return nil, encodeErr
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		return nil, closeErr
 	}
+	return buf.Bytes(), nil
 }
@@ -3,8 +3,17 @@ package main
 import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"os"
 	"sync"
+	"time"
+)
+
+const (
+	FILE_POLL_INTERVAL     = 5
+	DEFAULT_PROBE_INTERVAL = 60
+	DEFAULT_PROBE_COUNT    = 3
 )
 
 type VoyagerConfig struct {
@@ -12,7 +21,18 @@ type VoyagerConfig struct {
 	server          string
 	lock            sync.Mutex
 	targets         map[string]ProbeTarget
-	refreshInterval uint
+	refreshInterval time.Duration
+
+	// Standalone mode only, targets come from this file instead of voyager server
+	targetsFile    string
+	targetsModTime time.Time
+}
+
+// TargetsFile is the layout of the local targets file used in standalone mode. JSON is valid
+// YAML so either format works.
+type TargetsFile struct {
+	Targets []ProbeTarget `yaml:"targets"`
+	Sinks   []SinkConfig  `yaml:"sinks"`
 }
 
 func NewConfig() *VoyagerConfig {
@@ -33,13 +53,43 @@ func NewConfig() *VoyagerConfig {
 		token:           proberToken,
 		server:          voyagerServer,
 		targets:         make(map[string]ProbeTarget),
-		refreshInterval: REFRESH_INTERVAL,
+		refreshInterval: REFRESH_INTERVAL * time.Minute,
+	}
+}
+
+// NewFileConfig sets up standalone mode, where targets are read from a local file and picked
+// up again whenever the file changes. No voyager server credentials are needed.
+func NewFileConfig(path string) *VoyagerConfig {
+	return &VoyagerConfig{
+		targets:         make(map[string]ProbeTarget),
+		refreshInterval: FILE_POLL_INTERVAL * time.Second,
+		targetsFile:     path,
 	}
 }
 
 func (c *VoyagerConfig) updateTargets() {
-	log.Info("Updating targets from voyager server")
-	targetDefinitions, targetErr := getProbeTargets()
+	var targetDefinitions []ProbeTarget
+	var targetErr error
+	if c.targetsFile != "" {
+		info, statErr := os.Stat(c.targetsFile)
+		if statErr != nil {
+			log.Warn("Unable to update targets: ", statErr)
+			return
+		}
+		if info.ModTime().Equal(c.targetsModTime) {
+			return
+		}
+
+		log.Info("Loading targets from ", c.targetsFile)
+		targetDefinitions, targetErr = loadTargetsFile(c.targetsFile)
+		if targetErr == nil {
+			c.targetsModTime = info.ModTime()
+		}
+	} else {
+		log.Info("Updating targets from voyager server")
+		targetDefinitions, targetErr = getProbeTargets()
+	}
+
 	if targetErr != nil {
 		log.Warn("Unable to update targets: ", targetErr)
 		return
@@ -57,3 +107,57 @@ func (c *VoyagerConfig) updateTargets() {
 
 	log.Debug(fmt.Sprintf("New targets: %+v", newTargetHash))
 }
+
+// loadSinksFile reads the sinks out of a targets file, or a -sinks file with nothing else in
+// it. Unlike targets these are only read at startup.
+func loadSinksFile(path string) ([]SinkConfig, error) {
+	contents, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var targetsFile TargetsFile
+	if parseErr := yaml.UnmarshalStrict(contents, &targetsFile); parseErr != nil {
+		return nil, parseErr
+	}
+	return targetsFile.Sinks, nil
+}
+
+// loadTargetsFile reads and validates a local targets file. Unlike voyager server, nothing
+// upstream has checked these, so fill in sane defaults and reject what can't work.
+func loadTargetsFile(path string) ([]ProbeTarget, error) {
+	contents, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var targetsFile TargetsFile
+	if parseErr := yaml.UnmarshalStrict(contents, &targetsFile); parseErr != nil {
+		return nil, parseErr
+	}
+
+	seen := make(map[string]bool)
+	targets := make([]ProbeTarget, 0, len(targetsFile.Targets))
+	for i, target := range targetsFile.Targets {
+		if target.Destination == "" {
+			return nil, fmt.Errorf("target %d in %s has no destination", i, path)
+		}
+		if seen[target.Destination] {
+			return nil, fmt.Errorf("duplicate destination in %s: %s", path, target.Destination)
+		}
+		if invalidErr := target.validate(); invalidErr != nil {
+			return nil, invalidErr
+		}
+		seen[target.Destination] = true
+
+		if target.Interval == 0 {
+			target.Interval = DEFAULT_PROBE_INTERVAL
+		}
+		if target.ProbeCount == 0 {
+			target.ProbeCount = DEFAULT_PROBE_COUNT
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
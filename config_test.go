@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTargetsFile(t *testing.T, name string, contents string) string {
+	dir, dirErr := ioutil.TempDir("", "voyager-config")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if writeErr := ioutil.WriteFile(path, []byte(contents), 0644); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	return path
+}
+
+func TestLoadTargetsFileYAML(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTargetsFile(t, "targets.yaml", `
+targets:
+  - destination: 192.0.2.10
+    type: tcp
+    port: 443
+    interval: 30
+  - destination: example.com
+    type: icmp
+    paris: true
+`)
+
+	targets, loadErr := loadTargetsFile(path)
+	assert.Nil(loadErr)
+	assert.Equal(2, len(targets))
+	assert.Equal(ProbeTarget{Destination: "192.0.2.10", Type: "tcp", Port: 443, Interval: 30, ProbeCount: DEFAULT_PROBE_COUNT}, targets[0])
+	assert.Equal(uint(DEFAULT_PROBE_INTERVAL), targets[1].Interval, "interval defaulted")
+	assert.Equal(true, targets[1].Paris)
+}
+
+func TestLoadTargetsFileJSON(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTargetsFile(t, "targets.json", `{"targets": [{"destination": "192.0.2.10", "type": "udp", "probe_count": 5}]}`)
+
+	targets, loadErr := loadTargetsFile(path)
+	assert.Nil(loadErr)
+	assert.Equal(5, targets[0].ProbeCount)
+}
+
+func TestLoadTargetsFileRejectsBadTargets(t *testing.T) {
+	assert := assert.New(t)
+
+	duplicate := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: tcp}\n  - {destination: a, type: udp}\n")
+	_, dupErr := loadTargetsFile(duplicate)
+	assert.Error(dupErr, "duplicate destination rejected")
+
+	badType := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: sctp}\n")
+	_, typeErr := loadTargetsFile(badType)
+	assert.Error(typeErr, "unknown type rejected")
+
+	continuousPMTU := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: pmtu, continuous: true}\n")
+	_, continuousErr := loadTargetsFile(continuousPMTU)
+	assert.Error(continuousErr, "continuous type that can't be served rejected")
+
+	badDSCP := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: tcp, dscp: 64}\n")
+	_, dscpErr := loadTargetsFile(badDSCP)
+	assert.Error(dscpErr, "dscp out of range rejected")
+
+	badECN := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: tcp, ecn: 4}\n")
+	_, ecnErr := loadTargetsFile(badECN)
+	assert.Error(ecnErr, "ecn out of range rejected")
+
+	unknownField := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: tcp, prot: 80}\n")
+	_, fieldErr := loadTargetsFile(unknownField)
+	assert.Error(fieldErr, "typo in field name rejected")
+}
+
+func TestLoadSinksFileOnItsOwn(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTargetsFile(t, "sinks.yaml", `
+sinks:
+  - type: webhook
+    url: https://hooks.example.com/traceroute
+    headers:
+      Authorization: Bearer abc123
+  - type: file
+    path: /var/log/voyager/results.jsonl
+    max_size_mb: 50
+`)
+
+	sinks, loadErr := loadSinksFile(path)
+	assert.Nil(loadErr, "no targets needed")
+	assert.Equal(2, len(sinks))
+	assert.Equal("Bearer abc123", sinks[0].Headers["Authorization"])
+	assert.Equal(int64(50), sinks[1].MaxSizeMB)
+}
+
+func TestFileConfigReloadsOnChange(t *testing.T) {
+	assert := assert.New(t)
+	path := writeTargetsFile(t, "targets.yaml", "targets:\n  - {destination: a, type: tcp}\n")
+	config := NewFileConfig(path)
+
+	config.updateTargets()
+	_, ok := config.targets["a"]
+	assert.True(ok, "initial load")
+
+	ioutil.WriteFile(path, []byte("targets:\n  - {destination: b, type: tcp}\n"), 0644)
+	info, _ := os.Stat(path)
+	os.Chtimes(path, info.ModTime(), info.ModTime().Add(time.Second))
+	config.updateTargets()
+	_, okA := config.targets["a"]
+	_, okB := config.targets["b"]
+	assert.False(okA, "removed target dropped")
+	assert.True(okB, "new target picked up")
+}
+
+func TestServerTargetsValidated(t *testing.T) {
+	assert := assert.New(t)
+
+	// Targets from voyager server never go through loadTargetsFile, probeHandler checks them
+	var payload DRFResponse
+	body := `{"next": "", "results": [
+		{"destination": "192.0.2.10", "type": "tcp", "dscp": 46, "ecn": 2},
+		{"destination": "192.0.2.11", "type": "tcp", "dscp": 64},
+		{"destination": "192.0.2.12", "type": "udp", "ecn": 4},
+		{"destination": "192.0.2.13", "type": "pmtu", "continuous": true}
+	]}`
+	assert.Nil(json.Unmarshal([]byte(body), &payload))
+
+	assert.Nil(payload.Results[0].validate())
+	assert.Error(payload.Results[1].validate(), "dscp out of range rejected")
+	assert.Error(payload.Results[2].validate(), "ecn out of range rejected")
+	assert.Error(payload.Results[3].validate(), "continuous type that can't be served rejected")
+}
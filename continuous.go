@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	CONTINUOUS_DEFAULT_CYCLE_MS   = 1000
+	CONTINUOUS_DEFAULT_WINDOW     = 100
+	CONTINUOUS_REDISCOVERY_CYCLES = 10
+)
+
+// Continuous probers for every target running in continuous mode
+var continuousProbes = NewContinuousRegistry()
+
+// ContinuousRegistry holds the probers of every continuous target. removed is destinations
+// that are no longer targets, a probeHandler still on its way when that happened mustn't start
+// them back up.
+type ContinuousRegistry struct {
+	lock    sync.Mutex
+	probers map[string]*ContinuousProber
+	removed map[string]bool
+}
+
+func NewContinuousRegistry() *ContinuousRegistry {
+	return &ContinuousRegistry{probers: make(map[string]*ContinuousProber), removed: make(map[string]bool)}
+}
+
+// Snapshot is what probeHandler does for continuous targets on every interval. The first call
+// starts probing in the background and later ones report on the rolling window. A target whose
+// settings changed starts over, the window would mix two different kinds of probes otherwise.
+// Nothing is started for a removed destination.
+func (r *ContinuousRegistry) Snapshot(target ProbeTarget) (Probe, bool) {
+	r.lock.Lock()
+	if r.removed[target.Destination] {
+		r.lock.Unlock()
+		return Probe{}, false
+	}
+	prober, ok := r.probers[target.Destination]
+	if ok && !prober.sameSettings(target) {
+		prober.Stop()
+		ok = false
+	}
+	if !ok {
+		prober = NewContinuousProber(target)
+		r.probers[target.Destination] = prober
+		go prober.Run()
+	}
+	r.lock.Unlock()
+
+	return prober.Snapshot()
+}
+
+// Stop ends continuous probing of destination, if it was running at all
+func (r *ContinuousRegistry) Stop(destination string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stop(destination)
+}
+
+func (r *ContinuousRegistry) stop(destination string) {
+	if prober, ok := r.probers[destination]; ok {
+		prober.Stop()
+		delete(r.probers, destination)
+	}
+}
+
+// Remove stops destination for good, until it's added as a target again
+func (r *ContinuousRegistry) Remove(destination string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.stop(destination)
+	r.removed[destination] = true
+}
+
+// Add lets destination be probed again after it was removed
+func (r *ContinuousRegistry) Add(destination string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.removed, destination)
+}
+
+// ContinuousProber works like mtr. The path is discovered once, then every hop on it gets a
+// probe each cycle and the last window cycles are kept for rolling per hop stats. Probes all
+// go out on the same flow so every cycle measures the same path.
+type ContinuousProber struct {
+	target ProbeTarget
+	cycle  time.Duration
+	window int
+	stop   chan struct{}
+	once   sync.Once
+
+	lock      sync.Mutex
+	address   string
+	pathLen   int
+	cycles    [][]ProbeResponse
+	cycleTime []time.Time
+}
+
+func NewContinuousProber(target ProbeTarget) *ContinuousProber {
+	cycle := time.Duration(target.CycleMS) * time.Millisecond
+	if cycle <= 0 {
+		cycle = CONTINUOUS_DEFAULT_CYCLE_MS * time.Millisecond
+	}
+	window := target.Window
+	if window <= 0 {
+		window = CONTINUOUS_DEFAULT_WINDOW
+	}
+
+	return &ContinuousProber{
+		target: target,
+		cycle:  cycle,
+		window: window,
+		stop:   make(chan struct{}),
+	}
+}
+
+func (c *ContinuousProber) sameSettings(target ProbeTarget) bool {
+	// interval only changes how often we report, not what gets measured
+	current := c.target
+	current.Interval, target.Interval = 0, 0
+	return current == target
+}
+
+func (c *ContinuousProber) Stop() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+// Run probes until stopped. Only a single address of the target is ever probed, the first one
+// when it asks for all of them, as the window only makes sense for a single path. Getting
+// going is retried every cycle, a DNS hiccup shouldn't silence the target until it's restarted.
+func (c *ContinuousProber) Run() {
+	ticker := time.NewTicker(c.cycle)
+	defer ticker.Stop()
+
+	var send flowSender
+	lastErr := ""
+	for send == nil {
+		var closeFlows func()
+		var openErr error
+		send, closeFlows, openErr = c.open()
+		if openErr == nil {
+			defer closeFlows()
+			break
+		}
+
+		// Only worth a warning when something new went wrong
+		if openErr.Error() != lastErr {
+			log.Warn(fmt.Sprintf("Unable to start continuous probing of %s, retrying every %s: %s", c.target.Destination, c.cycle, openErr))
+			lastErr = openErr.Error()
+		} else {
+			log.Debug(fmt.Sprintf("Still unable to start continuous probing of %s: %s", c.target.Destination, openErr))
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	c.lock.Lock()
+	log.Info(fmt.Sprintf("Starting continuous %s probes to %s every %s", c.target.Type, c.address, c.cycle))
+	c.lock.Unlock()
+
+	unreached := 0
+	for {
+		// Walk the whole TTL range again when we've lost the destination for a while, the
+		// path may well have gotten longer.
+		pathLen := c.pathLen
+		if pathLen == 0 || unreached >= CONTINUOUS_REDISCOVERY_CYCLES {
+			pathLen = c.target.maxHops()
+		}
+
+		responses := c.probeCycle(send, pathLen)
+		if destination, reached := destinationTTL(responses); reached {
+			pathLen = destination
+			unreached = 0
+		} else {
+			unreached++
+		}
+		c.record(responses, pathLen)
+
+		select {
+		case <-c.stop:
+			log.Info("Stopping continuous probes to ", c.target.Destination)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// open resolves the target and gets a flow towards it
+func (c *ContinuousProber) open() (flowSender, func(), error) {
+	addresses, addrErr := targetAddresses(c.target)
+	if addrErr != nil {
+		return nil, nil, addrErr
+	}
+	targetIP := addresses[0]
+	c.lock.Lock()
+	c.address = targetIP.String()
+	c.lock.Unlock()
+
+	return continuousSender(c.target, targetIP)
+}
+
+// probeCycle sends one probe to every TTL up to pathLen at once and waits for all of them
+func (c *ContinuousProber) probeCycle(send flowSender, pathLen int) []ProbeResponse {
+	responses := make([]ProbeResponse, pathLen)
+	var probewg sync.WaitGroup
+	probewg.Add(pathLen)
+	for ttl := 1; ttl <= pathLen; ttl++ {
+		go func(ttl int) {
+			defer probewg.Done()
+			responses[ttl-1] = send(ttl, 0)
+		}(ttl)
+	}
+	probewg.Wait()
+	return responses
+}
+
+// record keeps a cycle, trimming anything past the destination, and drops cycles that fell
+// out of the window.
+func (c *ContinuousProber) record(responses []ProbeResponse, pathLen int) {
+	if len(responses) > pathLen {
+		responses = responses[:pathLen]
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pathLen = pathLen
+	c.cycles = append(c.cycles, responses)
+	c.cycleTime = append(c.cycleTime, time.Now())
+	if len(c.cycles) > c.window {
+		c.cycles = c.cycles[len(c.cycles)-c.window:]
+		c.cycleTime = c.cycleTime[len(c.cycleTime)-c.window:]
+	}
+}
+
+// Snapshot reports the window so far. Hops are the latest cycle as is, while the summary
+// covers every cycle in the window. False until the first cycle is done.
+func (c *ContinuousProber) Snapshot() (Probe, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.cycles) == 0 {
+		return Probe{}, false
+	}
+
+	samples := make([]ProbeResponse, 0, len(c.cycles)*c.pathLen)
+	for _, cycle := range c.cycles {
+		for _, response := range cycle {
+			// hops past the current path are from a discovery cycle, not worth reporting on
+			if response.TTL <= c.pathLen {
+				samples = append(samples, response)
+			}
+		}
+	}
+
+	latest := c.cycles[len(c.cycles)-1]
+	hops := make([]ProbeResponse, len(latest))
+	copy(hops, latest)
+	markQuoteChanges(hops)
+
+	return Probe{
+		Target:     c.target.Destination,
+		ResolvedIP: c.address,
+		StartTime:  c.cycleTime[0],
+		EndTime:    c.cycleTime[len(c.cycleTime)-1],
+		Hops:       hops,
+		Summary:    summarizeHops(samples),
+		Cycles:     len(c.cycles),
+	}, true
+}
+
+// continuousSupported tells whether continuousSender can ever get a flow for target
+func continuousSupported(target ProbeTarget) bool {
+	executorFactory, ok := probeTypeMap[target.Type]
+	if !ok {
+		return false
+	}
+	_, flows := executorFactory(target).(FlowProber)
+	return flows || target.Type == "icmp"
+}
+
+// continuousSender gets a single flow towards the target. TCP and UDP pin it with a flow,
+// ICMP echo probes all look the same to load balancers anyway.
+func continuousSender(target ProbeTarget, targetIP net.IP) (flowSender, func(), error) {
+	executorFactory, ok := probeTypeMap[target.Type]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported target protocol: %s", target.Type)
+	}
+
+	if flowProber, ok := executorFactory(target).(FlowProber); ok {
+		return flowProber.OpenFlows(targetIP, target.Port)
+	}
+	if target.Type == "icmp" {
+		send := func(ttl int, flow int) ProbeResponse {
+			return sendICMPProbe(targetIP, ttl, target.tos())
+		}
+		return send, func() {}, nil
+	}
+	return nil, nil, fmt.Errorf("continuous mode is not supported for %s probes", target.Type)
+}
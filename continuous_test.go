@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePath answers like a three hop path to 192.0.2.9, dropping every other probe at TTL 2
+func fakePath() flowSender {
+	sent := 0
+	return func(ttl int, flow int) ProbeResponse {
+		response := ProbeResponse{TTL: ttl}
+		if ttl == 2 {
+			sent++
+			if sent%2 == 0 {
+				return response
+			}
+		}
+		response.Responded = true
+		response.TimeMicros = int64(ttl * 1000)
+		response.IP = null.StringFrom(net.IPv4(10, 0, byte(ttl), 1).String())
+		response.HeaderDest = net.ParseIP("192.0.2.9")
+		if ttl >= 3 {
+			response.IP = null.StringFrom("192.0.2.9")
+		}
+		return response
+	}
+}
+
+func TestContinuousProberRollingWindow(t *testing.T) {
+	assert := assert.New(t)
+	prober := NewContinuousProber(ProbeTarget{Destination: "192.0.2.9", Type: "udp", Window: 4})
+	send := fakePath()
+
+	_, ok := prober.Snapshot()
+	assert.False(ok, "nothing to report before the first cycle")
+
+	// Discovery walks every TTL, later cycles only go as far as the destination
+	discovery := prober.probeCycle(send, MAX_HOPS)
+	pathLen, reached := destinationTTL(discovery)
+	assert.True(reached)
+	assert.Equal(3, pathLen)
+	prober.record(discovery, pathLen)
+	for i := 0; i < 5; i++ {
+		prober.record(prober.probeCycle(send, pathLen), pathLen)
+	}
+
+	snapshot, ok := prober.Snapshot()
+	assert.True(ok)
+	assert.Equal(4, snapshot.Cycles, "window caps the cycles kept")
+	assert.Equal(3, len(snapshot.Hops), "hops are the latest cycle")
+	assert.Equal(3, len(snapshot.Summary))
+
+	second := snapshot.Summary[1]
+	assert.Equal(4, second.Sent)
+	assert.Equal(2, second.Received)
+	assert.Equal(50.0, second.Loss, "intermittent loss shows up across cycles")
+	assert.Equal(null.FloatFrom(2), second.RTTAvg)
+	assert.Equal(null.FloatFrom(2), second.RTTLast)
+}
+
+func TestContinuousProberSettings(t *testing.T) {
+	assert := assert.New(t)
+	target := ProbeTarget{Destination: "192.0.2.9", Type: "udp", Interval: 60}
+	prober := NewContinuousProber(target)
+
+	target.Interval = 30
+	assert.True(prober.sameSettings(target), "interval only changes reporting")
+	target.Port = 53
+	assert.False(prober.sameSettings(target))
+}
+
+func TestContinuousProberRetriesResolution(t *testing.T) {
+	assert := assert.New(t)
+	defer func(original func(string) ([]net.IP, error)) { lookupIP = original }(lookupIP)
+	var lookups int32
+	lookupIP = func(host string) ([]net.IP, error) {
+		atomic.AddInt32(&lookups, 1)
+		return nil, fmt.Errorf("temporary failure in name resolution")
+	}
+
+	prober := NewContinuousProber(ProbeTarget{Destination: "example.com", Type: "udp", CycleMS: 10})
+	stopped := make(chan struct{})
+	go func() {
+		prober.Run()
+		close(stopped)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&lookups) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(atomic.LoadInt32(&lookups) >= 3, "resolution retried every cycle")
+
+	prober.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("prober didn't stop while retrying")
+	}
+}
+
+func TestContinuousRegistryRemovedDestination(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewContinuousRegistry()
+	target := ProbeTarget{Destination: "192.0.2.9", Type: "udp", Continuous: true}
+	registry.probers[target.Destination] = NewContinuousProber(target)
+
+	// A probeHandler that was already running when the target went away
+	registry.Remove(target.Destination)
+	_, ok := registry.Snapshot(target)
+	assert.False(ok)
+	assert.Equal(0, len(registry.probers), "removed destination not started back up")
+
+	registry.Add(target.Destination)
+	assert.False(registry.removed[target.Destination], "added back as a target")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"golang.org/x/net/icmp"
+	"gopkg.in/guregu/null.v4"
+)
+
+// RFC 5837 interface information objects. The two high bits of the C-Type are the role of the
+// interface, the low ones which attributes follow.
+const (
+	INTERFACE_ROLE_INCOMING = 0
+	INTERFACE_ATTR_MTU      = 0x01
+	INTERFACE_ATTR_NAME     = 0x02
+	INTERFACE_ATTR_IP_ADDR  = 0x04
+	INTERFACE_ATTR_IFINDEX  = 0x08
+)
+
+// MPLSLabel is one entry of the label stack a router quoted back in an ICMP extension
+// (RFC 4950). A hop that reports labels is inside an LSP, the top of the stack comes first.
+type MPLSLabel struct {
+	Label int  `json:"label"`
+	TC    int  `json:"tc"`
+	S     bool `json:"s"`
+	TTL   int  `json:"ttl"`
+}
+
+// HopInterface is the interface a probe came in on at a hop, as far as the router told us in an
+// RFC 5837 extension. Routers pick which attributes to include, the rest stay null.
+type HopInterface struct {
+	IfIndex null.Int    `json:"if_index"`
+	Address null.String `json:"address"`
+	Name    null.String `json:"name"`
+	MTU     null.Int    `json:"mtu"`
+}
+
+// icmpExtensions is the RFC 4884 extension structure tacked on after the quoted datagram. Only
+// Time Exceeded and Destination Unreachable carry one.
+func icmpExtensions(message *icmp.Message) []icmp.Extension {
+	switch body := message.Body.(type) {
+	case *icmp.TimeExceeded:
+		return body.Extensions
+	case *icmp.DstUnreach:
+		return body.Extensions
+	}
+	return nil
+}
+
+// quotedDatagram is the original datagram field of an ICMP error, without the extensions
+func quotedDatagram(message *icmp.Message) []byte {
+	switch body := message.Body.(type) {
+	case *icmp.TimeExceeded:
+		return body.Data
+	case *icmp.DstUnreach:
+		return body.Data
+	case *icmp.PacketTooBig:
+		return body.Data
+	}
+	return nil
+}
+
+func mplsLabels(extensions []icmp.Extension) []MPLSLabel {
+	var labels []MPLSLabel
+	for _, extension := range extensions {
+		stack, ok := extension.(*icmp.MPLSLabelStack)
+		if !ok {
+			continue
+		}
+		for _, label := range stack.Labels {
+			labels = append(labels, MPLSLabel{Label: label.Label, TC: label.TC, S: label.S, TTL: label.TTL})
+		}
+	}
+	return labels
+}
+
+// incomingInterface is the interface information object for the interface our probe arrived
+// on. Objects for the outgoing interface or next hop are of no use to us, nil if that's all
+// there is.
+func incomingInterface(extensions []icmp.Extension) *HopInterface {
+	for _, extension := range extensions {
+		info, ok := extension.(*icmp.InterfaceInfo)
+		if !ok || info.Type>>6 != INTERFACE_ROLE_INCOMING {
+			continue
+		}
+
+		hopInterface := &HopInterface{}
+		if info.Interface != nil {
+			if info.Type&INTERFACE_ATTR_IFINDEX != 0 {
+				hopInterface.IfIndex = null.IntFrom(int64(info.Interface.Index))
+			}
+			if info.Type&INTERFACE_ATTR_NAME != 0 {
+				hopInterface.Name = null.StringFrom(info.Interface.Name)
+			}
+			if info.Type&INTERFACE_ATTR_MTU != 0 {
+				hopInterface.MTU = null.IntFrom(int64(info.Interface.MTU))
+			}
+		}
+		// the zone x/net fills in for IPv6 is just the interface name again
+		if info.Type&INTERFACE_ATTR_IP_ADDR != 0 && info.Addr != nil {
+			hopInterface.Address = null.StringFrom(info.Addr.IP.String())
+		}
+		return hopInterface
+	}
+	return nil
+}
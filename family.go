@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// swapped out in tests
+var lookupIP = net.LookupIP
+
+// Values accepted in ProbeTarget.AddressFamily. Anything else is rejected at probe time.
+const (
+	FAMILY_ANY  = ""
+	FAMILY_IPV4 = "ipv4"
+	FAMILY_IPV6 = "ipv6"
+)
+
+// resolveTarget turns a destination into the address we will probe. An empty family takes
+// whatever the resolver hands back first, otherwise only addresses of that family count.
+func resolveTarget(destination string, family string) (net.IP, error) {
+	addrs, resolveErr := resolveAddresses(destination, family)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	return addrs[0], nil
+}
+
+// resolveAddresses is every address of family the destination resolves to, in the order the
+// resolver handed them back.
+func resolveAddresses(destination string, family string) ([]net.IP, error) {
+	if family != FAMILY_ANY && family != FAMILY_IPV4 && family != FAMILY_IPV6 {
+		return nil, fmt.Errorf("Unsupported address family: %s", family)
+	}
+
+	addrs, lookupErr := lookupIP(destination)
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+
+	matching := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if family == FAMILY_ANY || family == ipFamily(addr) {
+			matching = append(matching, addr)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("No %s address found for %s", family, destination)
+	}
+	return matching, nil
+}
+
+// targetAddresses is every address a target gets probed at, each one its own probe. That's
+// all of them with AllAddresses, otherwise just the one at AddressIndex, IE: the first.
+func targetAddresses(target ProbeTarget) ([]net.IP, error) {
+	addrs, resolveErr := resolveAddresses(target.Destination, target.AddressFamily)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	if target.AllAddresses {
+		return addrs, nil
+	}
+	if target.AddressIndex < 0 || target.AddressIndex >= len(addrs) {
+		return nil, fmt.Errorf("%s resolved to %d addresses, there is no address_index %d",
+			target.Destination, len(addrs), target.AddressIndex)
+	}
+	return addrs[target.AddressIndex : target.AddressIndex+1], nil
+}
+
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+// rawNetwork builds the network name net.Dial and friends expect for a raw socket carrying
+// proto towards ip, IE: ip4:tcp or ip6:tcp
+func rawNetwork(ip net.IP, proto string) string {
+	if ip.To4() != nil {
+		return "ip4:" + proto
+	}
+	return "ip6:" + proto
+}
+
+// ipHeaderLen is the size of the IP header our probes towards ip go out with
+func ipHeaderLen(ip net.IP) int {
+	if ip.To4() != nil {
+		return ipv4.HeaderLen
+	}
+	return ipv6.HeaderLen
+}
+
+// setConnTOS sets the TOS byte, or traffic class for IPv6, on an established connection
+func setConnTOS(conn net.Conn, ip net.IP, tos int) error {
+	if ip.To4() != nil {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	return ipv6.NewConn(conn).SetTrafficClass(tos)
+}
+
+// setConnTTL sets the unicast TTL, or hop limit for IPv6, on an established connection.
+func setConnTTL(conn net.Conn, ip net.IP, ttl int) error {
+	if ip.To4() != nil {
+		return ipv4.NewConn(conn).SetTTL(ttl)
+	}
+	return ipv6.NewConn(conn).SetHopLimit(ttl)
+}
+
+// addrIP pulls the IP out of the net.Addr implementations our sockets hand back
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestTargetAddresses(t *testing.T) {
+	assert := assert.New(t)
+	defer func(original func(string) ([]net.IP, error)) { lookupIP = original }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")}, nil
+	}
+
+	addresses, _ := targetAddresses(ProbeTarget{Destination: "anycast.example.net"})
+	assert.Equal([]net.IP{net.ParseIP("192.0.2.1")}, addresses, "first address by default")
+
+	addresses, _ = targetAddresses(ProbeTarget{Destination: "anycast.example.net", AllAddresses: true})
+	assert.Equal(3, len(addresses))
+
+	addresses, _ = targetAddresses(ProbeTarget{Destination: "anycast.example.net", AllAddresses: true, AddressFamily: FAMILY_IPV4})
+	assert.Equal([]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}, addresses)
+
+	addresses, _ = targetAddresses(ProbeTarget{Destination: "anycast.example.net", AddressIndex: 1, AddressFamily: FAMILY_IPV4})
+	assert.Equal([]net.IP{net.ParseIP("192.0.2.2")}, addresses)
+
+	_, indexErr := targetAddresses(ProbeTarget{Destination: "anycast.example.net", AddressIndex: 3})
+	assert.Error(indexErr)
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableHeaderIncluded has us write the IPv4 header of every packet sent on conn ourselves,
+// so we know exactly what left down to the IP ID the kernel would otherwise pick.
+func enableHeaderIncluded(conn *net.IPConn) error {
+	rawConn, rawErr := conn.SyscallConn()
+	if rawErr != nil {
+		return rawErr
+	}
+
+	var sockErr error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Writing our own IPv4 headers is only wired up on linux, everywhere else the kernel builds
+// them and the IP ID and DF flag of our probes are unknown to us.
+func enableHeaderIncluded(conn *net.IPConn) error {
+	return fmt.Errorf("writing IP headers not supported on this platform")
+}
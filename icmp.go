@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"os"
+	"time"
+)
+
+// Every echo request we send carries our PID as identifier so replies meant for other
+// ping processes on the box never match, the sequence number tells our own probes apart.
+var icmpEchoID = os.Getpid() & 0xffff
+
+func NewICMPProbeExecutor(target ProbeTarget) ProbeExecutor {
+	return &ICMPProbeExecutor{target}
+}
+
+type ICMPProbeExecutor struct {
+	ProbeTarget
+}
+
+func (e *ICMPProbeExecutor) Execute(target string, port uint16, count int) ([]ProbeResponse, error) {
+	targetIP, addrErr := resolveTarget(target, e.AddressFamily)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+	log.Debug(fmt.Sprintf("Look result: %s -> %s", target, targetIP))
+	target = targetIP.String()
+
+	log.Info("Starting ICMP probes to ", target)
+
+	// ICMP has no concept of ports, port is ignored entirely here
+	hops := traceHops(target, count, e.maxHops(), func(ttl int, attempt int) ProbeResponse {
+		return sendICMPProbe(targetIP, ttl, e.tos())
+	})
+
+	log.Debug("probe complete: ", target)
+	return hops, nil
+}
+
+func sendICMPProbe(targetIP net.IP, ttl int, tos int) ProbeResponse {
+	release := scheduler.StartProbe()
+	defer release()
+
+	probeResponse := ProbeResponse{TTL: ttl}
+	target := targetIP.String()
+
+	// Echo request types and the hop limit knob both differ between ICMP and ICMPv6
+	var echoType icmp.Type
+	var icmpConn *icmp.PacketConn
+	var connErr error
+	if targetIP.To4() != nil {
+		echoType = ipv4.ICMPTypeEcho
+		icmpConn, connErr = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		if connErr == nil {
+			icmpConn.IPv4PacketConn().SetTTL(ttl)
+			icmpConn.IPv4PacketConn().SetTOS(tos)
+		}
+	} else {
+		echoType = ipv6.ICMPTypeEchoRequest
+		icmpConn, connErr = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+		if connErr == nil {
+			icmpConn.IPv6PacketConn().SetHopLimit(ttl)
+			icmpConn.IPv6PacketConn().SetTrafficClass(tos)
+		}
+	}
+	if connErr != nil {
+		log.Warn("Error creating ICMP socket: ", connErr)
+		return probeResponse
+	}
+	defer icmpConn.Close()
+
+	seq := nextProbeID()
+	message := icmp.Message{
+		Type: echoType,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   icmpEchoID,
+			Seq:  int(seq),
+			Data: []byte("voyager"),
+		},
+	}
+	// Kernel fills in the ICMPv6 checksum for us, no pseudo header needed
+	payload, marshalErr := message.Marshal(nil)
+	if marshalErr != nil {
+		log.Warn("Error crafting ICMP echo request: ", marshalErr)
+		return probeResponse
+	}
+
+	lookupKey := ProbeKey{Protocol: "icmp", Destination: target, ID: uint32(seq)}
+	pending := received.Register(lookupKey)
+
+	// The socket isn't ours to write headers on, the kernel picks the source and IP ID
+	sent := SentPacket{TTL: ttl, TOS: tos, Protocol: protocolICMP, Transport: payload}
+	if targetIP.To4() == nil {
+		sent.Protocol = protocolICMPv6
+	}
+
+	scheduler.WaitPacket(target)
+	sentTime := time.Now()
+	_, writeErr := icmpConn.WriteTo(payload, &net.IPAddr{IP: targetIP})
+	if writeErr != nil {
+		log.Warn("ICMP write failed: ", writeErr)
+		pending.Cancel()
+		return probeResponse
+	}
+	probeResponse.sentAt = sentTime
+
+	response, lookupErr := pending.Wait(PROBE_LOOKUP_TIMEOUT * time.Second)
+	if lookupErr != nil {
+		log.Debug(lookupErr)
+		return probeResponse
+	}
+
+	rtt := response.Timestamp.Sub(sentTime)
+	probeResponse.IP = null.StringFrom(response.Source.String())
+	setRTT(&probeResponse, rtt)
+	probeResponse.Responded = true
+	probeResponse.setICMPDetails(sent, response)
+
+	return probeResponse
+}
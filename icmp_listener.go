@@ -6,164 +6,247 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	PROBE_LOOKUP_TIMEOUT  = 2
-	ICMP_STALE_AFTER      = 60
-	ICMP_CLEANUP_INTERVAL = 60
+	PROBE_LOOKUP_TIMEOUT = 2
+	ORPHAN_BUFFER_SIZE   = 1024
 )
 
-// TODO: cleanup on some interval or will potentially grow unchecked if we receive ICMP
-// traffic not meant for us on our socket?
-var received = ResponseMap{responses: map[string]ICMPResponse{}}
+// IANA protocol numbers used when parsing ICMP and quoted headers
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
 
-type ResponseMap struct {
-	lock      sync.Mutex
-	responses map[string]ICMPResponse
-}
+// Every probe registers with this before sending, the listener threads deliver into it
+var received = NewResponseMatcher(ORPHAN_BUFFER_SIZE)
 
 type ICMPResponse struct {
 	Response       *icmp.Message
-	OriginalHeader *ipv4.Header
+	OriginalHeader *QuotedHeader
 	Source         net.Addr
 	Timestamp      time.Time
+	MPLSLabels     []MPLSLabel
+	Interface      *HopInterface
+	ReplyTTL       int
+	// Next hop MTU out of a Fragmentation Needed or Packet Too Big, 0 for anything else
+	MTU int
+}
+
+// QuotedHeader is the part of our original IP header that was quoted back to us in an ICMP
+// error. IPv4 and IPv6 headers both boil down to this for matching purposes, TOS being the
+// traffic class and TTL the hop limit for IPv6. ID and DF only exist in IPv4. Transport is
+// whatever was quoted of the transport header.
+type QuotedHeader struct {
+	Version   int
+	Src       net.IP
+	Dst       net.IP
+	Protocol  int
+	TOS       int
+	TTL       int
+	ID        int
+	DF        bool
+	Transport []byte
 }
 
+// startICMPListener opens the listener sockets before returning, so nothing sent afterwards
+// can be answered before we're listening. Reading happens in the background.
 func startICMPListener() {
-	log.Info("Starting ICMP listener thread")
+	log.Info("Starting ICMP listener threads")
+
+	listenICMP("ip4:icmp", "0.0.0.0", protocolICMP)
+	listenICMP("ip6:ipv6-icmp", "::", protocolICMPv6)
+}
+
+func listenICMP(network string, address string, proto int) {
+	icmpConn, connErr := net.ListenIP(network, &net.IPAddr{IP: net.ParseIP(address)})
+	if connErr != nil {
+		log.Warn(connErr)
+		return
+	}
+
+	if timestampErr := enableKernelTimestamps(icmpConn); timestampErr != nil {
+		log.Warn("Kernel timestamps unavailable, response times include user space delay: ", timestampErr)
+	}
+	if proto == protocolICMPv6 {
+		if hopLimitErr := enableHopLimits(icmpConn); hopLimitErr != nil {
+			log.Warn("Hop limits unavailable, IPv6 replies won't have a TTL: ", hopLimitErr)
+		}
+	}
+
+	go readICMP(icmpConn, proto)
+}
 
+func readICMP(icmpConn *net.IPConn, proto int) {
 	recvBuffer := make([]byte, 1514)
+	oob := make([]byte, TIMESTAMP_OOB_SIZE)
 
-	go func() {
-		icmpConn, connErr := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
-		if connErr != nil {
-			log.Warn(connErr)
+	// TODO: context handler to ensure cleanup of socket
+	defer icmpConn.Close()
+
+	for {
+		packet, thisSrc, timestamp, replyTTL, recvErr := readTimestamped(icmpConn, recvBuffer, oob, proto == protocolICMP)
+		if recvErr != nil {
+			log.Warn(recvErr)
+			continue
 		}
+		atomic.AddUint64(&listenerPackets, 1)
 
-		// TODO: context handler to ensure cleanup of socket
-		defer icmpConn.Close()
-
-		for {
-			_, thisSrc, recvErr := icmpConn.ReadFrom(recvBuffer)
-			if recvErr != nil {
-				log.Warn(recvErr)
-			}
-			timestamp := time.Now()
-
-			icmpMessage, parseErr := icmp.ParseMessage(1, recvBuffer)
-			if parseErr != nil {
-				log.Warn(parseErr)
-				continue
-			}
-
-			icmpBody, bodyErr := icmpMessage.Body.Marshal(1)
-			if bodyErr != nil {
-				log.Warn(bodyErr)
-				continue
-			}
-
-			// Account for 4 "unused" bytes in ICMP message
-			originalHeader, headerErr := ipv4.ParseHeader(icmpBody[4:24])
-			if headerErr != nil {
-				panic(headerErr)
-			}
-
-			// TCP and UDP will contain original header data. Some nodes will not respond with full
-			// headers but we should be able to get the first 32 bits with source/dest port info.
-			// In the case of ICMP probes, we can use sequence number as a unique identifier of the
-			// original request
-			var srcPort, dstPort uint16
-			if originalHeader.Protocol == 6 || originalHeader.Protocol == 17 {
-				srcPort = binary.BigEndian.Uint16(icmpBody[24:26])
-				dstPort = binary.BigEndian.Uint16(icmpBody[26:28])
-			}
-
-			var originalProto string
-			switch originalHeader.Protocol {
-			case 6:
-				originalProto = "tcp"
-			case 17:
-				originalProto = "udp"
-			case 1:
-				originalProto = "icmp"
-			}
-
-			response := ICMPResponse{
-				Response:       icmpMessage,
-				OriginalHeader: originalHeader,
-				Source:         thisSrc,
-				Timestamp:      timestamp,
-			}
-
-			// We will use the original payload info as a key value on the lookup, for tcp/udp this
-			// can be port information. Since ICMP has no concepts of ports, we can use sequence numbers.
-			// IE: tcp:sourceport:dest:destport
-			// IE: icmp:sequence:dest
-			resultKey := fmt.Sprintf("%s:%d:%s:%d", originalProto, srcPort, originalHeader.Dst.String(), dstPort)
-			log.Debug("RESULTKEY: ", resultKey)
-			received.lock.Lock()
-			if _, exists := received.responses[resultKey]; exists {
-				log.Warn("Key exists already for probe! Overwriting ", resultKey)
-			}
-			received.responses[resultKey] = response
-			received.lock.Unlock()
-			debug := fmt.Sprintf("%+v", icmpMessage)
-			log.WithFields(log.Fields{"src": thisSrc}).Debug(debug)
+		resultKey, response, ok := parseICMPPacket(proto, packet, thisSrc, timestamp)
+		if !ok {
+			continue
 		}
-	}()
+		response.ReplyTTL = replyTTL
+
+		if !received.Deliver(resultKey, response) {
+			atomic.AddUint64(&unmatchedResponses, 1)
+		}
+		debug := fmt.Sprintf("%+v", response.Response)
+		log.WithFields(log.Fields{"src": thisSrc}).Debug(debug)
+	}
 }
 
-// Channels with contexts dont really work here. Since we're still reliant on every
-// reply coming back to the same ICMP socket, there's no way to guarentee that any
-// message coming back through the channel is ACTUALLY for data we care about...
-func lookupResponses(key string) (ICMPResponse, error) {
-	var lookupValue ICMPResponse
-	var err error
-	timeout := time.Now().Add(PROBE_LOOKUP_TIMEOUT * time.Second)
-	for tstamp := range time.Tick(500 * time.Millisecond) {
-		if tstamp.After(timeout) {
-			err = fmt.Errorf("Response lookup timed out: %s", key)
-			break
+// parseICMPPacket decodes a single ICMP or ICMPv6 message and works out which probe it
+// belongs to. Messages we have no use for, like echo requests from other hosts, return false.
+func parseICMPPacket(proto int, packet []byte, src net.Addr, timestamp time.Time) (ProbeKey, ICMPResponse, bool) {
+	icmpMessage, parseErr := icmp.ParseMessage(proto, packet)
+	if parseErr != nil {
+		log.Warn(parseErr)
+		return ProbeKey{}, ICMPResponse{}, false
+	}
+
+	response := ICMPResponse{
+		Response:  icmpMessage,
+		Source:    src,
+		Timestamp: timestamp,
+	}
+
+	switch icmpMessage.Type {
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+		// Echo replies come straight from the target and carry no quoted header, the
+		// identifier and sequence number we sent are all we need to match them up.
+		echo, ok := icmpMessage.Body.(*icmp.Echo)
+		if !ok || echo.ID != icmpEchoID {
+			return ProbeKey{}, response, false
 		}
+		return ProbeKey{Protocol: "icmp", Destination: addrIP(src).String(), ID: uint32(echo.Seq)}, response, true
+	case ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeDestinationUnreachable,
+		ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig:
+	default:
+		return ProbeKey{}, response, false
+	}
 
-		received.lock.Lock()
-		value, ok := received.responses[key]
-		if ok {
-			lookupValue = value
-			delete(received.responses, key)
-			received.lock.Unlock()
-			break
+	// The parsed body has the original datagram split from any extensions after it already
+	originalHeader, transport, headerErr := parseQuotedHeader(quotedDatagram(icmpMessage))
+	if headerErr != nil {
+		log.Debug(headerErr)
+		return ProbeKey{}, response, false
+	}
+	response.OriginalHeader = originalHeader
+	extensions := icmpExtensions(icmpMessage)
+	response.MPLSLabels = mplsLabels(extensions)
+	response.Interface = incomingInterface(extensions)
+	response.MTU = nextHopMTU(icmpMessage, packet)
+
+	// RFC 792 only guarantees the first 8 bytes of the original transport header are quoted,
+	// which is enough for every identifier we stamp into our probes.
+	if len(transport) < 8 {
+		log.Debug("Quoted transport header too short to identify probe")
+		return ProbeKey{}, response, false
+	}
+
+	resultKey := ProbeKey{Destination: originalHeader.Dst.String()}
+	switch originalHeader.Protocol {
+	case protocolTCP:
+		resultKey.Protocol = "tcp"
+		resultKey.ID = binary.BigEndian.Uint32(transport[4:8])
+	case protocolUDP:
+		resultKey.Protocol = "udp"
+		resultKey.ID = uint32(binary.BigEndian.Uint16(transport[6:8]))
+	case protocolICMP, protocolICMPv6:
+		// Quoted echo requests hold identifier and sequence after type, code and checksum
+		if int(binary.BigEndian.Uint16(transport[4:6])) != icmpEchoID {
+			return ProbeKey{}, response, false
 		}
-		received.lock.Unlock()
+		resultKey.Protocol = "icmp"
+		resultKey.ID = uint32(binary.BigEndian.Uint16(transport[6:8]))
+	default:
+		return ProbeKey{}, response, false
 	}
-	return lookupValue, err
+
+	return resultKey, response, true
 }
 
-// Only exists to schedule icmp response hash cleanup
-func icmpCleanupHandler() {
-	for {
-		time.Sleep(ICMP_CLEANUP_INTERVAL * time.Second)
-		removeStaleICMPResponses(&received)
+// nextHopMTU is the MTU a hop says it couldn't get our probe through. The icmp package drops
+// the unused word of a Destination Unreachable it lives in for IPv4, so it's read off packet,
+// RFC 1191 puts it in the low 16 bits.
+func nextHopMTU(message *icmp.Message, packet []byte) int {
+	switch message.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		if message.Code != 4 || len(packet) < 8 {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(packet[6:8]))
+	case ipv6.ICMPTypePacketTooBig:
+		if body, ok := message.Body.(*icmp.PacketTooBig); ok {
+			return body.MTU
+		}
 	}
+	return 0
 }
 
-// Broken out into it's own function to make it easier to test
-func removeStaleICMPResponses(responsemap *ResponseMap) {
-	log.Debug("Starting ICMP stale response cleanup")
-	responsemap.lock.Lock()
-
-	// range will give us a copy of the value not a reference
-	for key, response := range responsemap.responses {
-		timeSince := time.Now().Sub(response.Timestamp)
-		isExpired := timeSince.Seconds() >= ICMP_STALE_AFTER
-		if isExpired {
-			delete(responsemap.responses, key)
+// parseQuotedHeader reads the original IPv4 or IPv6 header out of an ICMP error body and
+// returns it alongside whatever was quoted of the transport header that followed it.
+func parseQuotedHeader(quoted []byte) (*QuotedHeader, []byte, error) {
+	if len(quoted) < 1 {
+		return nil, nil, fmt.Errorf("ICMP message too short to contain original header")
+	}
+
+	switch quoted[0] >> 4 {
+	case ipv4.Version:
+		header, headerErr := ipv4.ParseHeader(quoted)
+		if headerErr != nil {
+			return nil, nil, headerErr
+		}
+		if len(quoted) < header.Len {
+			return nil, nil, fmt.Errorf("quoted IPv4 header truncated")
 		}
+		quotedHeader := &QuotedHeader{
+			Version:  ipv4.Version,
+			Src:      header.Src,
+			Dst:      header.Dst,
+			Protocol: header.Protocol,
+			TOS:      header.TOS,
+			TTL:      header.TTL,
+			ID:       header.ID,
+			DF:       quotedIPv4Flags(quoted),
+		}
+		quotedHeader.Transport = append([]byte{}, quoted[header.Len:]...)
+		return quotedHeader, quoted[header.Len:], nil
+	case ipv6.Version:
+		// Extension headers are not walked, probes we send never carry any
+		header, headerErr := ipv6.ParseHeader(quoted)
+		if headerErr != nil {
+			return nil, nil, headerErr
+		}
+		quotedHeader := &QuotedHeader{
+			Version:  ipv6.Version,
+			Src:      header.Src,
+			Dst:      header.Dst,
+			Protocol: header.NextHeader,
+			TOS:      header.TrafficClass,
+			TTL:      header.HopLimit,
+		}
+		quotedHeader.Transport = append([]byte{}, quoted[ipv6.HeaderLen:]...)
+		return quotedHeader, quoted[ipv6.HeaderLen:], nil
 	}
-	responsemap.lock.Unlock()
-	log.Debug("ICMP stale response cleanup done")
+
+	return nil, nil, fmt.Errorf("unknown IP version in quoted header: %d", quoted[0]>>4)
 }
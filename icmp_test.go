@@ -1,64 +1,170 @@
 package main
 
 import (
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gopkg.in/guregu/null.v4"
+	"net"
 	"testing"
 	"time"
 )
 
-func TestIcmpCleanupNoAction(t *testing.T) {
-	assert := assert.New(t)
-	response1 := ICMPResponse{
-		Timestamp: time.Now(),
+func craftQuotedUDP(src, dst net.IP, srcPort, dstPort uint16, checksum uint16) []byte {
+	var ipHeader []byte
+	if dst.To4() != nil {
+		header := ipv4.Header{
+			Version:  ipv4.Version,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + 8,
+			TTL:      1,
+			Protocol: 17,
+			Src:      src,
+			Dst:      dst,
+		}
+		ipHeader, _ = header.Marshal()
+	} else {
+		ipHeader = make([]byte, ipv6.HeaderLen)
+		ipHeader[0] = ipv6.Version << 4
+		ipHeader[6] = 17
+		ipHeader[7] = 1
+		copy(ipHeader[8:24], src.To16())
+		copy(ipHeader[24:40], dst.To16())
 	}
-	responsemap := ResponseMap{responses: map[string]ICMPResponse{
-		"test-node": response1,
-	}}
 
-	removeStaleICMPResponses(&responsemap)
-	_, ok := responsemap.responses["test-node"]
+	udpHeader := make([]byte, 8)
+	binary.BigEndian.PutUint16(udpHeader[0:2], srcPort)
+	binary.BigEndian.PutUint16(udpHeader[2:4], dstPort)
+	binary.BigEndian.PutUint16(udpHeader[6:8], checksum)
+	return append(ipHeader, udpHeader...)
+}
+
+func TestParseICMPTimeExceeded(t *testing.T) {
+	assert := assert.New(t)
+
+	quoted := craftQuotedUDP(net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7"), 40000, 33434, 4242)
+	message := icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	packet, _ := message.Marshal(nil)
 
-	assert.Equal(true, ok, "test-node key exists")
+	key, response, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	assert.Equal(true, ok, "time exceeded parsed")
+	assert.Equal(ProbeKey{Protocol: "udp", Destination: "198.51.100.7", ID: 4242}, key)
+	assert.Equal("192.0.2.2", response.OriginalHeader.Src.String())
 }
 
-func TestIcmpCleanupRemoveKey(t *testing.T) {
+func TestParseICMPMPLSExtension(t *testing.T) {
 	assert := assert.New(t)
-	response1 := ICMPResponse{
-		Timestamp: time.Now().Add(time.Duration(-2) * time.Minute),
-	}
-	response2 := ICMPResponse{
-		Timestamp: time.Now().Add(time.Duration(-15) * time.Second),
-	}
-	responsemap := ResponseMap{responses: map[string]ICMPResponse{
-		"test-1": response1,
-		"test-2": response2,
-	}}
 
-	removeStaleICMPResponses(&responsemap)
-	_, test1ok := responsemap.responses["test-1"]
-	_, test2ok := responsemap.responses["test-2"]
+	quoted := craftQuotedUDP(net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7"), 40000, 33434, 4242)
+	stack := &icmp.MPLSLabelStack{Class: 1, Type: 1, Labels: []icmp.MPLSLabel{
+		{Label: 24005, TC: 0, S: false, TTL: 1},
+		{Label: 16, TC: 5, S: true, TTL: 1},
+	}}
+	message := icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted, Extensions: []icmp.Extension{stack}}}
+	packet, _ := message.Marshal(nil)
 
-	assert.Equal(false, test1ok, "test-1 key removed")
-	assert.Equal(true, test2ok, "test-2 key was not removed")
+	key, response, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	assert.Equal(true, ok, "quoted header found in front of the extensions")
+	assert.Equal(ProbeKey{Protocol: "udp", Destination: "198.51.100.7", ID: 4242}, key)
+	assert.Equal([]MPLSLabel{{Label: 24005, TTL: 1}, {Label: 16, TC: 5, S: true, TTL: 1}}, response.MPLSLabels)
 }
 
-func TestResponseLookup(t *testing.T) {
+func TestParseICMPInterfaceExtension(t *testing.T) {
 	assert := assert.New(t)
-	response1 := ICMPResponse{
-		Timestamp: time.Now().Add(time.Duration(-2) * time.Minute),
-	}
-	response2 := ICMPResponse{
-		Timestamp: time.Now().Add(time.Duration(-15) * time.Second),
+
+	quoted := craftQuotedUDP(net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7"), 40000, 33434, 4242)
+	outgoing := &icmp.InterfaceInfo{Class: 2, Type: 0x80 | 0x0a, Interface: &net.Interface{Index: 7, Name: "xe-0/0/1"}}
+	incoming := &icmp.InterfaceInfo{
+		Class:     2,
+		Type:      0x0f,
+		Interface: &net.Interface{Index: 15, Name: "xe-0/0/3.100", MTU: 9000},
+		Addr:      &net.IPAddr{IP: net.ParseIP("192.0.2.1").To4()},
 	}
-	received = ResponseMap{responses: map[string]ICMPResponse{
-		"test-1": response1,
-		"test-2": response2,
-	}}
+	body := &icmp.TimeExceeded{Data: quoted, Extensions: []icmp.Extension{outgoing, incoming}}
+	packet, _ := (&icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: body}).Marshal(nil)
+
+	_, response, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	assert.Equal(true, ok)
+	assert.Equal(&HopInterface{
+		IfIndex: null.IntFrom(15),
+		Address: null.StringFrom("192.0.2.1"),
+		Name:    null.StringFrom("xe-0/0/3.100"),
+		MTU:     null.IntFrom(9000),
+	}, response.Interface, "outgoing interface skipped")
+
+	body.Extensions = []icmp.Extension{outgoing}
+	packet, _ = (&icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: body}).Marshal(nil)
+	_, response, _ = parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	assert.Nil(response.Interface)
+}
+
+func TestParseICMPv6TimeExceeded(t *testing.T) {
+	assert := assert.New(t)
+
+	quoted := craftQuotedUDP(net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8:1::7"), 40000, 33434, 4242)
+	message := icmp.Message{Type: ipv6.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	packet, _ := message.Marshal(nil)
+
+	key, response, ok := parseICMPPacket(58, packet, &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, time.Now())
+	assert.Equal(true, ok, "time exceeded parsed")
+	assert.Equal(ProbeKey{Protocol: "udp", Destination: "2001:db8:1::7", ID: 4242}, key)
+	assert.Equal(17, response.OriginalHeader.Protocol)
+}
+
+func TestParseICMPNextHopMTU(t *testing.T) {
+	assert := assert.New(t)
+
+	quoted := craftQuotedUDP(net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7"), 40000, 33434, 4242)
+	message := icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: quoted}}
+	packet, _ := message.Marshal(nil)
+	binary.BigEndian.PutUint16(packet[6:8], 1400)
+
+	key, response, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, time.Now())
+	assert.Equal(true, ok, "fragmentation needed parsed")
+	assert.Equal(ProbeKey{Protocol: "udp", Destination: "198.51.100.7", ID: 4242}, key)
+	assert.Equal(1400, response.MTU)
+
+	quoted = craftQuotedUDP(net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8:1::7"), 40000, 33434, 4242)
+	message = icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{MTU: 1420, Data: quoted}}
+	packet, _ = message.Marshal(nil)
+
+	key, response, ok = parseICMPPacket(58, packet, &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, time.Now())
+	assert.Equal(true, ok, "packet too big parsed")
+	assert.Equal(ProbeKey{Protocol: "udp", Destination: "2001:db8:1::7", ID: 4242}, key)
+	assert.Equal(1420, response.MTU)
+
+	var hop ProbeResponse
+	hop.setICMPDetails(SentPacket{}, response)
+	assert.Equal(null.IntFrom(1420), hop.NextHopMTU)
+	assert.True(hop.tooBig)
+}
+
+func TestParseICMPEchoReply(t *testing.T) {
+	assert := assert.New(t)
+
+	message := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: icmpEchoID, Seq: 7}}
+	packet, _ := message.Marshal(nil)
+
+	key, response, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("198.51.100.7")}, time.Now())
+	assert.Equal(true, ok, "echo reply parsed")
+	assert.Equal(ProbeKey{Protocol: "icmp", Destination: "198.51.100.7", ID: 7}, key)
+	assert.Nil(response.OriginalHeader)
+}
+
+func TestParseICMPIgnoresEchoRequest(t *testing.T) {
+	message := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1234, Seq: 7}}
+	packet, _ := message.Marshal(nil)
+
+	_, _, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("198.51.100.7")}, time.Now())
+	assert.Equal(t, false, ok, "echo request ignored")
+}
 
-	value1, lookupErr1 := lookupResponses("test-1")
-	_, lookupErr2 := lookupResponses("test-3")
-	assert.Equal(value1, response1, "lookup failed")
-	assert.Equal(nil, lookupErr1, "lookup err is nill")
-	assert.EqualError(lookupErr2, "Response lookup timed out: test-3")
+func TestParseICMPIgnoresForeignEchoReply(t *testing.T) {
+	message := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: icmpEchoID + 1, Seq: 7}}
+	packet, _ := message.Marshal(nil)
 
+	_, _, ok := parseICMPPacket(1, packet, &net.IPAddr{IP: net.ParseIP("198.51.100.7")}, time.Now())
+	assert.Equal(t, false, ok, "echo reply for another process ignored")
 }
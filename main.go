@@ -4,13 +4,14 @@ import (
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"os"
 	"time"
 )
 
 const (
 	TIMEOUT          = 30
-	CONCURRENCY      = 10
+	CONCURRENCY      = 100
 	MAX_HOPS         = 20
 	REFRESH_INTERVAL = 1
 )
@@ -19,19 +20,58 @@ var proberToken string
 var voyagerServer string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		os.Exit(runTrace(os.Args[2:]))
+	}
+
+	debugLog := flag.Bool("d", false, "debug")
+	targetsFile := flag.String("config", "", "standalone mode, read targets from this YAML/JSON file instead of voyager server")
+	resultsPath := flag.String("results", "-", "standalone mode, append results as JSON lines to this file, - for stdout. Ignored if any sinks are set up")
+	var sinkFlags sinkFlag
+	flag.Var(&sinkFlags, "sink", "send results here, repeat for more than one: voyager, stdout, file=PATH or webhook=URL")
+	sinksFile := flag.String("sinks", "", "read sinks from this YAML/JSON file too, for webhook headers, templates and file rotation")
+	spoolDir := flag.String("spool", SPOOL_DEFAULT_DIR, "directory results are spooled to until voyager server has them, empty to disable")
+	spoolMaxMB := flag.Int64("spool-max-mb", SPOOL_DEFAULT_MAX_MB, "drop the oldest spooled results past this many megabytes")
+	spoolMaxAge := flag.Duration("spool-max-age", SPOOL_DEFAULT_MAX_AGE, "drop spooled results older than this")
+	batchSize := flag.Int("batch-size", BATCH_DEFAULT_SIZE, "upload results in batches of up to this many, 1 to disable batching")
+	batchWindow := flag.Duration("batch-window", BATCH_DEFAULT_WINDOW, "longest a result waits for its batch to fill up")
+	concurrency := flag.Int("concurrency", CONCURRENCY, "most probes waiting on an answer at once, the rest wait their turn")
+	globalPPS := flag.Float64("pps", DEFAULT_GLOBAL_PPS, "packets per second budget across all probes, 0 for unlimited")
+	destinationPPS := flag.Float64("dest-pps", DEFAULT_DESTINATION_PPS, "packets per second budget per destination, 0 for unlimited")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on /metrics at this address, ie :9100")
+	rdnsResolver := flag.String("rdns-resolver", "", "send reverse DNS lookups to this resolver (host:port) instead of the system one")
+	rdnsTTL := flag.Duration("rdns-ttl", RDNS_DEFAULT_TTL, "how long reverse DNS names are cached")
+	rdnsNegativeTTL := flag.Duration("rdns-negative-ttl", RDNS_DEFAULT_NEGATIVE_TTL, "how long failed reverse DNS lookups are cached")
+	rdnsTimeout := flag.Duration("rdns-timeout", RDNS_DEFAULT_TIMEOUT, "give up on a reverse DNS lookup after this long")
+	rdnsConcurrency := flag.Int("rdns-concurrency", RDNS_DEFAULT_CONCURRENCY, "most reverse DNS lookups running at once")
+	flag.Parse()
+
+	spoolSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "spool" {
+			spoolSet = true
+		}
+	})
+
+	scheduler = NewScheduler(*concurrency, *globalPPS, *destinationPPS)
+	rdnsCache = NewDNSCache(*rdnsTTL, *rdnsNegativeTTL, *rdnsTimeout, *rdnsConcurrency, *rdnsResolver)
+
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+
 	proberToken = os.Getenv("VOYAGER_PROBE_TOKEN")
 	voyagerServer = os.Getenv("VOYAGER_SERVER")
 
-	if proberToken == "" {
-		log.Fatal("VOYAGER_PROBE_TOKEN env var required but not set")
-	}
+	if *targetsFile == "" {
+		if proberToken == "" {
+			log.Fatal("VOYAGER_PROBE_TOKEN env var required but not set")
+		}
 
-	if voyagerServer == "" {
-		log.Fatal("VOYAGER_SERVER env var required but not set")
+		if voyagerServer == "" {
+			log.Fatal("VOYAGER_SERVER env var required but not set")
+		}
 	}
-
-	debugLog := flag.Bool("d", false, "debug")
-	flag.Parse()
 	customFormatter := new(log.TextFormatter)
 
 	// Yea, this is real stupid. For some reason this wants a reference timestamp?
@@ -46,8 +86,78 @@ func main() {
 
 	log.Info("Starting...")
 
+	// The voyager server sink holds results in the spool, or batches them in memory without one.
+	// The default spool directory not being usable is no reason not to start, one asked for is.
+	newVoyagerSink := func() (ResultSink, error) {
+		if proberToken == "" || voyagerServer == "" {
+			return nil, fmt.Errorf("voyager sink needs VOYAGER_SERVER and VOYAGER_PROBE_TOKEN set")
+		}
+		if *spoolDir == "" {
+			return NewResultBatcher(*batchSize, *batchWindow, uploadProbeBatch), nil
+		}
+		spool, spoolErr := NewSpool(*spoolDir, *spoolMaxMB*1024*1024, *spoolMaxAge, *batchSize, *batchWindow, uploadProbeBatch)
+		if spoolErr != nil {
+			if spoolSet {
+				return nil, spoolErr
+			}
+			log.Warn("Spool unavailable, results won't survive voyager server being unreachable: ", spoolErr)
+			return NewResultBatcher(*batchSize, *batchWindow, uploadProbeBatch), nil
+		}
+		go spool.Run()
+		return spool, nil
+	}
+
+	sinkConfigs := []SinkConfig(sinkFlags)
+	if *sinksFile != "" {
+		fileSinks, sinksErr := loadSinksFile(*sinksFile)
+		if sinksErr != nil {
+			log.Fatal("Unable to load sinks file: ", sinksErr)
+		}
+		sinkConfigs = append(sinkConfigs, fileSinks...)
+	}
+	var config *VoyagerConfig
+	if *targetsFile != "" {
+		log.Info("Running standalone with targets from ", *targetsFile)
+		config = NewFileConfig(*targetsFile)
+		if _, loadErr := loadTargetsFile(*targetsFile); loadErr != nil {
+			log.Fatal("Unable to load targets file: ", loadErr)
+		}
+
+		fileSinks, sinksErr := loadSinksFile(*targetsFile)
+		if sinksErr != nil {
+			log.Fatal("Unable to load sinks from targets file: ", sinksErr)
+		}
+		sinkConfigs = append(sinkConfigs, fileSinks...)
+		if len(sinkConfigs) == 0 {
+			if *resultsPath == "-" {
+				sinkConfigs = append(sinkConfigs, SinkConfig{Type: SINK_STDOUT})
+			} else {
+				sinkConfigs = append(sinkConfigs, SinkConfig{Type: SINK_FILE, Path: *resultsPath})
+			}
+		}
+	} else {
+		config = NewConfig()
+		if len(sinkConfigs) == 0 {
+			sinkConfigs = append(sinkConfigs, SinkConfig{Type: SINK_VOYAGER})
+		}
+	}
+
+	sinks, sinksErr := buildSinks(sinkConfigs, newVoyagerSink)
+	if sinksErr != nil {
+		log.Fatal("Unable to set up result sinks: ", sinksErr)
+	}
+	resultSinks = sinks
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			log.Info("Serving metrics on ", *metricsAddr)
+			log.Fatal(http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
 	startICMPListener()
-	config := NewConfig()
 	currentProbers := make(map[string]chan int)
 	for {
 		// TODO: LOCKING IN HERE
@@ -57,6 +167,9 @@ func main() {
 			if _, ok := config.targets[currentDest]; !ok {
 				log.Info("Stopping prober goroutine for ", currentDest)
 				delete(currentProbers, currentDest)
+				metrics.ForgetTarget(currentDest)
+				continuousProbes.Remove(currentDest)
+				pathTracker.ForgetTarget(currentDest)
 				doneChan <- 1
 			}
 		}
@@ -67,6 +180,7 @@ func main() {
 				log.Info("Starting prober goroutine for ", destination)
 				done := make(chan int, 1)
 				currentProbers[destination] = done
+				continuousProbes.Add(destination)
 				go func(destination string, done chan int) {
 					ticker := time.NewTicker(time.Duration(config.targets[destination].Interval) * time.Second)
 					currentTickTime := config.targets[destination].Interval
@@ -98,6 +212,22 @@ func main() {
 				}(destination, done)
 			}
 		}
-		time.Sleep(REFRESH_INTERVAL * time.Minute)
+		time.Sleep(config.refreshInterval)
+	}
+}
+
+// sinkFlag collects every -sink given on the command line
+type sinkFlag []SinkConfig
+
+func (f *sinkFlag) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+func (f *sinkFlag) Set(value string) error {
+	config, parseErr := parseSinkFlag(value)
+	if parseErr != nil {
+		return parseErr
 	}
+	*f = append(*f, config)
+	return nil
 }
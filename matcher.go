@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var probeIDCounter uint32
+
+// ProbeKey identifies a single probe. ID is stamped into a field of the packet we send that
+// comes back to us in the quote of an ICMP error, or in the reply itself:
+//
+//	tcp:  sequence number
+//	udp:  checksum, steered through the payload
+//	icmp: echo sequence number
+//
+// That way two probes sharing the same 5-tuple can still be told apart.
+type ProbeKey struct {
+	Protocol    string
+	Destination string
+	ID          uint32
+}
+
+func (k ProbeKey) String() string {
+	return fmt.Sprintf("%s:%s:%d", k.Protocol, k.Destination, k.ID)
+}
+
+// nextProbeID hands out identifiers that are unique across in-flight probes. They have to fit
+// in 16 bits for UDP and ICMP, and 0 and 0xffff are skipped since a UDP checksum can't be
+// either of those on the wire.
+func nextProbeID() uint16 {
+	for {
+		id := uint16(atomic.AddUint32(&probeIDCounter, 1))
+		if id != 0 && id != 0xffff {
+			return id
+		}
+	}
+}
+
+// ResponseMatcher pairs ICMP responses read by the listener with the probe that is waiting
+// for them. Probes register the key they expect before the packet goes out, so the listener
+// can hand the response straight over instead of parking it somewhere to be polled for.
+type ResponseMatcher struct {
+	lock    sync.Mutex
+	waiters map[ProbeKey]chan ICMPResponse
+
+	// Anything nobody was waiting for ends up here. It's a fixed size ring so stray ICMP
+	// traffic hitting our sockets can't grow it unchecked.
+	orphans     []ICMPResponse
+	orphanNext  int
+	orphanCount int
+}
+
+// PendingResponse is a registration for a single expected response
+type PendingResponse struct {
+	key      ProbeKey
+	response chan ICMPResponse
+	matcher  *ResponseMatcher
+}
+
+func NewResponseMatcher(orphanBufferSize int) *ResponseMatcher {
+	return &ResponseMatcher{
+		waiters: make(map[ProbeKey]chan ICMPResponse),
+		orphans: make([]ICMPResponse, orphanBufferSize),
+	}
+}
+
+// Register announces that a probe expects a response matching key. It must be called
+// before the probe is sent so a fast reply can't beat the registration.
+func (m *ResponseMatcher) Register(key ProbeKey) *PendingResponse {
+	pending := &PendingResponse{
+		key:      key,
+		response: make(chan ICMPResponse, 1),
+		matcher:  m,
+	}
+
+	m.lock.Lock()
+	if _, exists := m.waiters[key]; exists {
+		log.Warn("Probe already registered for key! Replacing ", key)
+	}
+	m.waiters[key] = pending.response
+	m.lock.Unlock()
+
+	return pending
+}
+
+// Deliver hands a response to whoever registered for key. Returns false if nobody was
+// waiting, in which case the response is kept in the orphan buffer.
+func (m *ResponseMatcher) Deliver(key ProbeKey, response ICMPResponse) bool {
+	log.Debug("RESULTKEY: ", key)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	waiter, ok := m.waiters[key]
+	if !ok {
+		m.addOrphan(response)
+		return false
+	}
+
+	// Registrations are one-shot, duplicates after this are orphans
+	delete(m.waiters, key)
+	waiter <- response
+	return true
+}
+
+func (m *ResponseMatcher) addOrphan(response ICMPResponse) {
+	if len(m.orphans) == 0 {
+		return
+	}
+	m.orphans[m.orphanNext] = response
+	m.orphanNext = (m.orphanNext + 1) % len(m.orphans)
+	if m.orphanCount < len(m.orphans) {
+		m.orphanCount++
+	}
+}
+
+// Orphans returns a copy of the unmatched responses currently buffered, oldest first
+func (m *ResponseMatcher) Orphans() []ICMPResponse {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	orphans := make([]ICMPResponse, 0, m.orphanCount)
+	if len(m.orphans) == 0 {
+		return orphans
+	}
+	start := (m.orphanNext - m.orphanCount + len(m.orphans)) % len(m.orphans)
+	for i := 0; i < m.orphanCount; i++ {
+		orphans = append(orphans, m.orphans[(start+i)%len(m.orphans)])
+	}
+	return orphans
+}
+
+// Response exposes the channel the matched response is delivered on, for callers that need
+// to select on it alongside something else.
+func (p *PendingResponse) Response() <-chan ICMPResponse {
+	return p.response
+}
+
+// Wait blocks until the response shows up or timeout passes. The registration is removed
+// either way.
+func (p *PendingResponse) Wait(timeout time.Duration) (ICMPResponse, error) {
+	defer p.Cancel()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case response := <-p.response:
+		return response, nil
+	case <-timer.C:
+		return ICMPResponse{}, fmt.Errorf("Response lookup timed out: %s", p.key)
+	}
+}
+
+// Cancel drops the registration if it has not been matched yet. Safe to call more than once.
+func (p *PendingResponse) Cancel() {
+	p.matcher.lock.Lock()
+	if waiter, ok := p.matcher.waiters[p.key]; ok && waiter == p.response {
+		delete(p.matcher.waiters, p.key)
+	}
+	p.matcher.lock.Unlock()
+}
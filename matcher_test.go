@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testKey1 = ProbeKey{Protocol: "udp", Destination: "192.0.2.1", ID: 1}
+var testKey3 = ProbeKey{Protocol: "tcp", Destination: "192.0.2.3", ID: 3}
+
+func TestMatcherDeliversToWaiter(t *testing.T) {
+	assert := assert.New(t)
+	matcher := NewResponseMatcher(4)
+	response1 := ICMPResponse{
+		Timestamp: time.Now(),
+	}
+
+	pending := matcher.Register(testKey1)
+	delivered := matcher.Deliver(testKey1, response1)
+	value1, lookupErr1 := pending.Wait(time.Second)
+
+	assert.Equal(true, delivered, "response delivered to waiter")
+	assert.Equal(response1, value1, "lookup failed")
+	assert.Equal(nil, lookupErr1, "lookup err is nill")
+	assert.Equal(0, len(matcher.Orphans()), "nothing orphaned")
+}
+
+func TestMatcherTimeout(t *testing.T) {
+	assert := assert.New(t)
+	matcher := NewResponseMatcher(4)
+
+	pending := matcher.Register(testKey3)
+	start := time.Now()
+	_, lookupErr := pending.Wait(50 * time.Millisecond)
+
+	assert.EqualError(lookupErr, "Response lookup timed out: tcp:192.0.2.3:3")
+	assert.True(time.Since(start) < time.Second, "timeout honored per probe")
+
+	// Registration is gone after a timeout, late responses become orphans
+	delivered := matcher.Deliver(testKey3, ICMPResponse{})
+	assert.Equal(false, delivered, "late response not delivered")
+	assert.Equal(1, len(matcher.Orphans()), "late response orphaned")
+}
+
+func TestMatcherOrphanBufferBounded(t *testing.T) {
+	assert := assert.New(t)
+	matcher := NewResponseMatcher(3)
+	base := time.Now()
+
+	for i := 0; i < 5; i++ {
+		matcher.Deliver(ProbeKey{Protocol: "udp", Destination: "192.0.2.9", ID: 9}, ICMPResponse{Timestamp: base.Add(time.Duration(i) * time.Second)})
+	}
+
+	orphans := matcher.Orphans()
+	assert.Equal(3, len(orphans), "orphan buffer capped")
+	assert.Equal(base.Add(2*time.Second), orphans[0].Timestamp, "oldest orphans dropped first")
+	assert.Equal(base.Add(4*time.Second), orphans[2].Timestamp, "newest orphan kept")
+
+	unbuffered := NewResponseMatcher(0)
+	unbuffered.Deliver(ProbeKey{Protocol: "udp", Destination: "192.0.2.9", ID: 9}, ICMPResponse{})
+	assert.Equal(0, len(unbuffered.Orphans()), "no buffer, no orphans")
+}
+
+func TestMatcherDuplicateIsOrphaned(t *testing.T) {
+	assert := assert.New(t)
+	matcher := NewResponseMatcher(4)
+
+	pending := matcher.Register(testKey1)
+	assert.Equal(true, matcher.Deliver(testKey1, ICMPResponse{}))
+	assert.Equal(false, matcher.Deliver(testKey1, ICMPResponse{}), "duplicate not delivered")
+	pending.Cancel()
+	assert.Equal(1, len(matcher.Orphans()))
+}
+
+func TestMatcherKeysSharingTuple(t *testing.T) {
+	assert := assert.New(t)
+	matcher := NewResponseMatcher(4)
+	key1 := ProbeKey{Protocol: "udp", Destination: "192.0.2.1", ID: 10}
+	key2 := ProbeKey{Protocol: "udp", Destination: "192.0.2.1", ID: 11}
+	response1 := ICMPResponse{Timestamp: time.Now()}
+	response2 := ICMPResponse{Timestamp: time.Now().Add(time.Second)}
+
+	pending1 := matcher.Register(key1)
+	pending2 := matcher.Register(key2)
+	matcher.Deliver(key2, response2)
+	matcher.Deliver(key1, response1)
+
+	value1, _ := pending1.Wait(time.Second)
+	value2, _ := pending2.Wait(time.Second)
+	assert.Equal(response1, value1, "first probe got its own response")
+	assert.Equal(response2, value2, "second probe got its own response")
+}
+
+func TestNextProbeIDSkipsReserved(t *testing.T) {
+	for i := 0; i < 0x20000; i++ {
+		id := nextProbeID()
+		if id == 0 || id == 0xffff {
+			t.Fatalf("reserved probe id handed out: %d", id)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	MDA_DEFAULT_CONFIDENCE = 0.95
+	MDA_MAX_FLOWS          = 128
+)
+
+// ProbeGraph is the set of interfaces found at every TTL and the links seen between them. Every
+// node and edge lists the flows that were observed crossing it.
+type ProbeGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	ID    int    `json:"id"`
+	IP    string `json:"ip"`
+	TTL   int    `json:"ttl"`
+	Flows []int  `json:"flows"`
+}
+
+// GraphEdge links two nodes by ID, Source being the node one TTL closer to us
+type GraphEdge struct {
+	Source int   `json:"source"`
+	Target int   `json:"target"`
+	Flows  []int `json:"flows"`
+}
+
+func NewMDAProbeExecutor(target ProbeTarget, prober FlowProber) ProbeExecutor {
+	return &MDAProbeExecutor{target, prober}
+}
+
+// MDAProbeExecutor enumerates the load balanced paths towards a target with a hop level take
+// on the Multipath Detection Algorithm. At every TTL it keeps sending probes on new flows until
+// enough have been sent to rule out an undiscovered next hop at the configured confidence.
+// Flows probed at a TTL are also probed at the TTL before it, so every flow yields links.
+type MDAProbeExecutor struct {
+	ProbeTarget
+	prober FlowProber
+}
+
+func (m *MDAProbeExecutor) Execute(target string, port uint16, count int) ([]ProbeResponse, error) {
+	targetIP, addrErr := resolveTarget(target, m.AddressFamily)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+	target = targetIP.String()
+
+	confidence := m.MDAConfidence
+	if confidence <= 0 || confidence >= 1 {
+		confidence = MDA_DEFAULT_CONFIDENCE
+	}
+
+	send, closeFlows, flowErr := m.prober.OpenFlows(targetIP, port)
+	if flowErr != nil {
+		return nil, flowErr
+	}
+	defer closeFlows()
+
+	// count is ignored here, the stopping rule decides how many probes every hop gets
+	log.Info(fmt.Sprintf("Starting %s MDA probes to %s", m.Type, target))
+
+	// responses[ttl][flow], filled in as we go so no flow is ever probed twice at a TTL
+	responses := make(map[int]map[int]ProbeResponse)
+	probeFlows := func(ttl int, flows []int) {
+		var lock sync.Mutex
+		var probewg sync.WaitGroup
+		probewg.Add(len(flows))
+		for _, flow := range flows {
+			go func(flow int) {
+				defer probewg.Done()
+				response := send(ttl, flow)
+				lock.Lock()
+				responses[ttl][flow] = response
+				lock.Unlock()
+			}(flow)
+		}
+		probewg.Wait()
+	}
+
+	for ttl := 1; ttl <= m.maxHops(); ttl++ {
+		responses[ttl] = make(map[int]ProbeResponse)
+
+		for {
+			interfaces := respondingInterfaces(responses[ttl])
+			needed := mdaStoppingPoint(len(interfaces), confidence)
+			if needed > MDA_MAX_FLOWS {
+				needed = MDA_MAX_FLOWS
+			}
+			if len(responses[ttl]) >= needed {
+				break
+			}
+
+			flows := make([]int, 0, needed-len(responses[ttl]))
+			for flow := len(responses[ttl]); flow < needed; flow++ {
+				flows = append(flows, flow)
+			}
+			probeFlows(ttl, flows)
+		}
+
+		// Fill in the previous TTL for any flow we only just started using, otherwise we
+		// would not know which interface it came through and lose the link.
+		if ttl > 1 {
+			missing := make([]int, 0)
+			for flow := range responses[ttl] {
+				if _, ok := responses[ttl-1][flow]; !ok {
+					missing = append(missing, flow)
+				}
+			}
+			probeFlows(ttl-1, missing)
+		}
+
+		if reachedTarget(responses[ttl], target) || allUnreachable(responses[ttl]) {
+			break
+		}
+	}
+
+	hops := make([]ProbeResponse, 0)
+	for ttl := 1; ttl <= len(responses); ttl++ {
+		flows := make([]int, 0, len(responses[ttl]))
+		for flow := range responses[ttl] {
+			flows = append(flows, flow)
+		}
+		sort.Ints(flows)
+		for _, flow := range flows {
+			hops = append(hops, responses[ttl][flow])
+		}
+	}
+
+	log.Debug("MDA probe complete: ", target)
+	return hops, nil
+}
+
+// mdaStoppingPoint is the number of probes needed at a hop where k interfaces were found to
+// rule out a k+1th one with the given confidence, assuming load balancers spread flows
+// uniformly. Even a hop nobody answered gets the same budget as one with a single interface.
+func mdaStoppingPoint(k int, confidence float64) int {
+	if k < 1 {
+		k = 1
+	}
+	kf := float64(k)
+	return int(math.Ceil(math.Log((1-confidence)/(kf+1)) / math.Log(kf/(kf+1))))
+}
+
+func respondingInterfaces(responses map[int]ProbeResponse) map[string]bool {
+	interfaces := make(map[string]bool)
+	for _, response := range responses {
+		if response.Responded {
+			interfaces[response.IP.String] = true
+		}
+	}
+	return interfaces
+}
+
+// reachedTarget is true once every flow that got an answer at this TTL got it from the target
+func reachedTarget(responses map[int]ProbeResponse, target string) bool {
+	interfaces := respondingInterfaces(responses)
+	return len(interfaces) == 1 && interfaces[target]
+}
+
+// allUnreachable is true when every flow that got an answer at this TTL was told the target
+// can't be reached. One filtered branch alone doesn't end the run, the others may still go on.
+func allUnreachable(responses map[int]ProbeResponse) bool {
+	answered := 0
+	for _, response := range responses {
+		if !response.Responded {
+			continue
+		}
+		if !response.Unreachable.Valid {
+			return false
+		}
+		answered++
+	}
+	return answered > 0
+}
+
+// buildProbeGraph turns flow tagged responses into a graph. Nodes are unique per TTL and IP,
+// and consecutive TTLs answered on the same flow give an edge. Flows with a silent hop in
+// between get no edge across the gap.
+func buildProbeGraph(hops []ProbeResponse) *ProbeGraph {
+	type nodeKey struct {
+		ttl int
+		ip  string
+	}
+	type edgeKey struct {
+		source int
+		target int
+	}
+
+	graph := &ProbeGraph{Nodes: make([]GraphNode, 0), Edges: make([]GraphEdge, 0)}
+	nodeIDs := make(map[nodeKey]int)
+	edgeIDs := make(map[edgeKey]int)
+	flowPaths := make(map[int]map[int]int)
+
+	sorted := make([]ProbeResponse, len(hops))
+	copy(sorted, hops)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].TTL != sorted[j].TTL {
+			return sorted[i].TTL < sorted[j].TTL
+		}
+		return sorted[i].FlowID.Int64 < sorted[j].FlowID.Int64
+	})
+
+	for _, hop := range sorted {
+		if !hop.Responded || !hop.FlowID.Valid {
+			continue
+		}
+		flow := int(hop.FlowID.Int64)
+		key := nodeKey{hop.TTL, hop.IP.String}
+		id, ok := nodeIDs[key]
+		if !ok {
+			id = len(graph.Nodes)
+			nodeIDs[key] = id
+			graph.Nodes = append(graph.Nodes, GraphNode{ID: id, IP: hop.IP.String, TTL: hop.TTL, Flows: make([]int, 0)})
+		}
+		graph.Nodes[id].Flows = append(graph.Nodes[id].Flows, flow)
+
+		if _, ok := flowPaths[flow]; !ok {
+			flowPaths[flow] = make(map[int]int)
+		}
+		flowPaths[flow][hop.TTL] = id
+
+		previous, ok := flowPaths[flow][hop.TTL-1]
+		if !ok {
+			continue
+		}
+		edge := edgeKey{previous, id}
+		edgeID, ok := edgeIDs[edge]
+		if !ok {
+			edgeID = len(graph.Edges)
+			edgeIDs[edge] = edgeID
+			graph.Edges = append(graph.Edges, GraphEdge{Source: previous, Target: id, Flows: make([]int, 0)})
+		}
+		graph.Edges[edgeID].Flows = append(graph.Edges[edgeID].Flows, flow)
+	}
+
+	return graph
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"testing"
+)
+
+func TestMDAStoppingPoints(t *testing.T) {
+	assert := assert.New(t)
+
+	// Published MDA stopping points for 95% confidence
+	assert.Equal(6, mdaStoppingPoint(0, 0.95), "silent hop gets single interface budget")
+	assert.Equal(6, mdaStoppingPoint(1, 0.95))
+	assert.Equal(11, mdaStoppingPoint(2, 0.95))
+	assert.Equal(16, mdaStoppingPoint(3, 0.95))
+	assert.True(mdaStoppingPoint(1, 0.99) > mdaStoppingPoint(1, 0.95), "higher confidence costs more probes")
+}
+
+func flowHop(ttl int, flow int64, ip string) ProbeResponse {
+	return ProbeResponse{TTL: ttl, FlowID: null.IntFrom(flow), IP: null.StringFrom(ip), Responded: true}
+}
+
+func TestBuildProbeGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	hops := []ProbeResponse{
+		flowHop(2, 1, "10.0.3.2"),
+		flowHop(1, 0, "10.0.1.1"),
+		flowHop(1, 1, "10.0.1.1"),
+		flowHop(2, 0, "10.0.2.2"),
+		flowHop(3, 0, "10.0.6.2"),
+		flowHop(3, 1, "10.0.6.2"),
+		{TTL: 2, FlowID: null.IntFrom(2)},
+	}
+
+	graph := buildProbeGraph(hops)
+	assert.Equal(4, len(graph.Nodes), "one node per TTL and IP")
+	assert.Equal(GraphNode{ID: 0, IP: "10.0.1.1", TTL: 1, Flows: []int{0, 1}}, graph.Nodes[0])
+	assert.Equal(4, len(graph.Edges), "diamond has four links")
+
+	edges := make(map[[2]string][]int)
+	for _, edge := range graph.Edges {
+		edges[[2]string{graph.Nodes[edge.Source].IP, graph.Nodes[edge.Target].IP}] = edge.Flows
+	}
+	assert.Equal([]int{0}, edges[[2]string{"10.0.1.1", "10.0.2.2"}])
+	assert.Equal([]int{1}, edges[[2]string{"10.0.1.1", "10.0.3.2"}])
+	assert.Equal([]int{1}, edges[[2]string{"10.0.3.2", "10.0.6.2"}])
+}
+
+func TestBuildProbeGraphSkipsGaps(t *testing.T) {
+	hops := []ProbeResponse{
+		flowHop(1, 0, "10.0.1.1"),
+		{TTL: 2, FlowID: null.IntFrom(0)},
+		flowHop(3, 0, "10.0.6.2"),
+	}
+
+	graph := buildProbeGraph(hops)
+	assert.Equal(t, 2, len(graph.Nodes))
+	assert.Equal(t, 0, len(graph.Edges), "no link across a silent hop")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters the agent keeps about itself, bumped with sync/atomic from wherever they happen
+var (
+	listenerPackets    uint64
+	unmatchedResponses uint64
+	uploadFailures     uint64
+	skippedRuns        uint64
+)
+
+// Last result of every address of every target, served up on /metrics in the Prometheus text format
+var metrics = NewMetricsRegistry()
+
+type targetResult struct {
+	target ProbeTarget
+	probe  Probe
+}
+
+type MetricsRegistry struct {
+	lock    sync.Mutex
+	results map[string][]targetResult
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{results: make(map[string][]targetResult)}
+}
+
+// RecordProbes replaces whatever we had for the target with this interval's probes, one per
+// address, so an address the target stopped resolving to isn't reported forever.
+func (m *MetricsRegistry) RecordProbes(target ProbeTarget, probes []Probe) {
+	results := make([]targetResult, 0, len(probes))
+	for _, probe := range probes {
+		results = append(results, targetResult{target, probe})
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.results[target.Destination] = results
+}
+
+// ForgetTarget drops a target that isn't being probed anymore, otherwise its last result
+// would be reported forever.
+func (m *MetricsRegistry) ForgetTarget(destination string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.results, destination)
+}
+
+func (m *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo renders every metric family. Families are written whole, one after the other, as
+// the exposition format wants all samples of a metric grouped under its HELP and TYPE.
+func (m *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	m.lock.Lock()
+	results := make([]targetResult, 0, len(m.results))
+	for _, targetResults := range m.results {
+		results = append(results, targetResults...)
+	}
+	m.lock.Unlock()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].target.Destination != results[j].target.Destination {
+			return results[i].target.Destination < results[j].target.Destination
+		}
+		return results[i].probe.ResolvedIP < results[j].probe.ResolvedIP
+	})
+
+	families := []*metricFamily{
+		newMetricFamily("voyager_hop_rtt_min_seconds", "gauge", "Fastest response from a hop in the last probe"),
+		newMetricFamily("voyager_hop_rtt_avg_seconds", "gauge", "Average response time from a hop in the last probe"),
+		newMetricFamily("voyager_hop_rtt_max_seconds", "gauge", "Slowest response from a hop in the last probe"),
+		newMetricFamily("voyager_hop_loss_ratio", "gauge", "Share of probes at a TTL that got no response in the last probe"),
+		newMetricFamily("voyager_hop_count", "gauge", "TTL the destination answered at, or the highest TTL probed if it never did"),
+		newMetricFamily("voyager_destination_reached", "gauge", "Whether the destination answered the last probe"),
+		newMetricFamily("voyager_probe_duration_seconds", "gauge", "How long the last probe took from start to end"),
+		newMetricFamily("voyager_probe_timestamp_seconds", "gauge", "Unix time the last probe ended"),
+	}
+	rttMin, rttAvg, rttMax, loss, hopCount, reached, duration, timestamp := families[0], families[1],
+		families[2], families[3], families[4], families[5], families[6], families[7]
+
+	for _, result := range results {
+		labels := []string{
+			"target", result.target.Destination,
+			"address", result.probe.ResolvedIP,
+			"type", result.target.Type,
+			"port", strconv.Itoa(int(result.target.Port)),
+		}
+		probe := result.probe
+
+		for _, hop := range summarizeHops(probe.Hops) {
+			ttlLabels := append(labels[:len(labels):len(labels)], "ttl", strconv.Itoa(hop.TTL))
+			loss.add(ttlLabels, hop.Loss/100)
+			for _, ip := range hop.Addresses {
+				// per address stats, summaries only carry them for the whole TTL
+				stats := rttStats(hop.rtts[ip])
+				ipLabels := append(ttlLabels[:len(ttlLabels):len(ttlLabels)], "hop_ip", ip)
+				rttMin.add(ipLabels, stats.min/1000)
+				rttAvg.add(ipLabels, stats.avg/1000)
+				rttMax.add(ipLabels, stats.max/1000)
+			}
+		}
+
+		count, ok := destinationTTL(probe.Hops)
+		reached.add(labels, boolGauge(ok))
+		hopCount.add(labels, float64(count))
+		duration.add(labels, probe.EndTime.Sub(probe.StartTime).Seconds())
+		timestamp.add(labels, float64(probe.EndTime.UnixNano())/1e9)
+	}
+
+	agent := []*metricFamily{
+		newMetricFamily("voyager_probes_in_flight", "gauge", "Probes currently waiting on an answer"),
+		newMetricFamily("voyager_listener_packets_total", "counter", "ICMP packets read by the listener"),
+		newMetricFamily("voyager_unmatched_responses_total", "counter", "ICMP responses that did not match any outstanding probe"),
+		newMetricFamily("voyager_upload_failures_total", "counter", "Failed attempts to upload results to voyager server"),
+		newMetricFamily("voyager_rdns_cache_hits_total", "counter", "Reverse DNS lookups answered from the cache"),
+		newMetricFamily("voyager_rdns_cache_misses_total", "counter", "Reverse DNS lookups that went to the resolver"),
+		newMetricFamily("voyager_skipped_runs_total", "counter", "Probe runs skipped because the target already had one going and one waiting"),
+	}
+	agent[0].add(nil, float64(scheduler.InFlight()))
+	agent[1].add(nil, float64(atomic.LoadUint64(&listenerPackets)))
+	agent[2].add(nil, float64(atomic.LoadUint64(&unmatchedResponses)))
+	agent[3].add(nil, float64(atomic.LoadUint64(&uploadFailures)))
+	agent[4].add(nil, float64(rdnsCache.Hits()))
+	agent[5].add(nil, float64(rdnsCache.Misses()))
+	agent[6].add(nil, float64(atomic.LoadUint64(&skippedRuns)))
+
+	var buf bytes.Buffer
+	for _, family := range append(families, agent...) {
+		family.writeTo(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// isDestinationResponse tells whether the destination itself answered rather than a hop along
+// the way. Direct replies, SYN-ACKs and echo replies, quote nothing, and an ICMP error coming
+// from the very address the probe was sent to, like port unreachable, is the destination too.
+func isDestinationResponse(hop ProbeResponse) bool {
+	if !hop.Responded {
+		return false
+	}
+	return hop.HeaderDest == nil || hop.HeaderDest.Equal(net.ParseIP(hop.IP.ValueOrZero()))
+}
+
+// destinationTTL is the lowest TTL the destination answered at. If it never did, it's the
+// highest TTL probed and false.
+func destinationTTL(hops []ProbeResponse) (int, bool) {
+	highest, reached := 0, 0
+	for _, hop := range hops {
+		if hop.TTL > highest {
+			highest = hop.TTL
+		}
+		if isDestinationResponse(hop) && (reached == 0 || hop.TTL < reached) {
+			reached = hop.TTL
+		}
+	}
+	if reached == 0 {
+		return highest, false
+	}
+	return reached, true
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []string
+}
+
+func newMetricFamily(name, kind, help string) *metricFamily {
+	return &metricFamily{name: name, kind: kind, help: help}
+}
+
+// add records a sample, labels being name value pairs
+func (f *metricFamily) add(labels []string, value float64) {
+	var sample strings.Builder
+	sample.WriteString(f.name)
+	if len(labels) > 0 {
+		sample.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				sample.WriteString(",")
+			}
+			sample.WriteString(fmt.Sprintf("%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1])))
+		}
+		sample.WriteString("}")
+	}
+	sample.WriteString(" ")
+	sample.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, sample.String())
+}
+
+func (f *metricFamily) writeTo(buf *bytes.Buffer) {
+	if len(f.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, sample := range f.samples {
+		buf.WriteString(sample)
+		buf.WriteString("\n")
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
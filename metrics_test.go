@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewMetricsRegistry()
+	start := time.Unix(1600000000, 0)
+	target := ProbeTarget{Destination: "192.0.2.9", Type: "udp", Port: 33434}
+
+	registry.RecordProbes(target, []Probe{{
+		Target:     target.Destination,
+		ResolvedIP: "192.0.2.9",
+		StartTime:  start,
+		EndTime:    start.Add(1500 * time.Millisecond),
+		Hops: []ProbeResponse{
+			{TTL: 1, Responded: true, IP: null.StringFrom("10.0.0.1"), Time: 2, HeaderDest: net.ParseIP("192.0.2.9")},
+			{TTL: 1, Responded: true, IP: null.StringFrom("10.0.0.1"), Time: 4, HeaderDest: net.ParseIP("192.0.2.9")},
+			{TTL: 1},
+			{TTL: 2, Responded: true, IP: null.StringFrom("192.0.2.9"), Time: 10, HeaderDest: net.ParseIP("192.0.2.9")},
+		},
+	}})
+
+	var buf bytes.Buffer
+	registry.WriteTo(&buf)
+	out := buf.String()
+
+	assert.Contains(out, "# TYPE voyager_hop_rtt_avg_seconds gauge\n")
+	assert.Contains(out, `voyager_hop_rtt_min_seconds{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434",ttl="1",hop_ip="10.0.0.1"} 0.002`)
+	assert.Contains(out, `voyager_hop_rtt_avg_seconds{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434",ttl="1",hop_ip="10.0.0.1"} 0.003`)
+	assert.Contains(out, `voyager_hop_rtt_max_seconds{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434",ttl="1",hop_ip="10.0.0.1"} 0.004`)
+	assert.Contains(out, `voyager_hop_loss_ratio{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434",ttl="1"} 0.3333333333333333`)
+	assert.Contains(out, `voyager_hop_count{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434"} 2`)
+	assert.Contains(out, `voyager_destination_reached{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434"} 1`)
+	assert.Contains(out, `voyager_probe_duration_seconds{target="192.0.2.9",address="192.0.2.9",type="udp",port="33434"} 1.5`)
+	assert.Contains(out, "voyager_probes_in_flight ")
+
+	registry.ForgetTarget(target.Destination)
+	buf.Reset()
+	registry.WriteTo(&buf)
+	assert.NotContains(buf.String(), "192.0.2.9", "forgotten targets not reported")
+}
+
+func TestDestinationTTL(t *testing.T) {
+	assert := assert.New(t)
+	transit := ProbeResponse{TTL: 1, Responded: true, IP: null.StringFrom("10.0.0.1"), HeaderDest: net.ParseIP("192.0.2.9")}
+
+	ttl, reached := destinationTTL([]ProbeResponse{transit, {TTL: 2}, {TTL: 3}})
+	assert.Equal(3, ttl)
+	assert.False(reached)
+
+	// SYN-ACKs and echo replies quote nothing
+	ttl, reached = destinationTTL([]ProbeResponse{transit, {TTL: 2, Responded: true, IP: null.StringFrom("192.0.2.9")}})
+	assert.Equal(2, ttl)
+	assert.True(reached)
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabelValue("a\"b\\c\nd"))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stands in for a TTL nothing answered at
+const SILENT_HOP = "*"
+
+// Last known path of every address of every target, compared against each new probe
+var pathTracker = NewPathTracker()
+
+// PathChange is reported alongside a probe whose path differs from the one before it.
+// DivergeTTL is the first TTL the two disagree at.
+type PathChange struct {
+	OldPath        []string  `json:"old_path"`
+	NewPath        []string  `json:"new_path"`
+	OldFingerprint string    `json:"old_fingerprint"`
+	NewFingerprint string    `json:"new_fingerprint"`
+	OldReached     bool      `json:"old_reached"`
+	NewReached     bool      `json:"new_reached"`
+	DivergeTTL     int       `json:"diverge_ttl"`
+	PreviousTime   time.Time `json:"previous_time"`
+	DetectedTime   time.Time `json:"detected_time"`
+}
+
+type knownPath struct {
+	hops        []string
+	fingerprint string
+	reached     bool
+	seen        time.Time
+}
+
+// PathTracker keeps paths by destination, then by the address probed. Different addresses of a
+// multi-homed target can sit behind entirely different paths, so rotating through them in DNS
+// isn't a path change.
+type PathTracker struct {
+	lock  sync.Mutex
+	paths map[string]map[string]knownPath
+}
+
+func NewPathTracker() *PathTracker {
+	return &PathTracker{paths: make(map[string]map[string]knownPath)}
+}
+
+// Observe fingerprints the probe's path and compares it to the last one seen for the same
+// address of the target. The fingerprint always comes back, the change only when there was one.
+func (p *PathTracker) Observe(target ProbeTarget, probe Probe) (string, *PathChange) {
+	hops, reached := probePath(probe, target.MDA)
+	current := knownPath{hops: hops, fingerprint: pathFingerprint(hops, reached), reached: reached, seen: probe.EndTime}
+
+	p.lock.Lock()
+	addresses, ok := p.paths[target.Destination]
+	if !ok {
+		addresses = make(map[string]knownPath)
+		p.paths[target.Destination] = addresses
+	}
+	previous, ok := addresses[probe.ResolvedIP]
+	remembered := current
+	if ok && target.IgnoreSilentHops {
+		// Remember who was at a silent TTL last time, or the next probe would be compared
+		// against a wildcard and a real change there would slip by.
+		remembered.hops = append([]string{}, current.hops...)
+		for i := 0; i < len(remembered.hops) && i < len(previous.hops); i++ {
+			if remembered.hops[i] == SILENT_HOP {
+				remembered.hops[i] = previous.hops[i]
+			}
+		}
+	}
+	addresses[probe.ResolvedIP] = remembered
+	p.lock.Unlock()
+
+	if !ok {
+		return current.fingerprint, nil
+	}
+
+	diverge := divergeTTL(previous.hops, current.hops, target.IgnoreSilentHops)
+	if diverge == 0 && previous.reached == current.reached {
+		return current.fingerprint, nil
+	}
+
+	change := &PathChange{
+		OldPath:        previous.hops,
+		NewPath:        current.hops,
+		OldFingerprint: previous.fingerprint,
+		NewFingerprint: current.fingerprint,
+		OldReached:     previous.reached,
+		NewReached:     current.reached,
+		DivergeTTL:     diverge,
+		PreviousTime:   previous.seen,
+		DetectedTime:   current.seen,
+	}
+	log.WithFields(log.Fields{"target": target.Destination, "address": probe.ResolvedIP, "ttl": diverge}).Warn(fmt.Sprintf(
+		"Path changed from %s to %s", strings.Join(change.OldPath, " "), strings.Join(change.NewPath, " "),
+	))
+	return current.fingerprint, change
+}
+
+// ForgetTarget drops the path of a target that isn't probed anymore
+func (p *PathTracker) ForgetTarget(destination string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.paths, destination)
+}
+
+// probePath is the address seen at every TTL up to the destination, or up to the last hop that
+// answered if we never got there. MDA probes see every load balanced branch at once, so their
+// TTLs are the whole set of addresses rather than a best guess that would flap between them.
+func probePath(probe Probe, multipath bool) ([]string, bool) {
+	last, reached := destinationTTL(probe.Hops)
+	hops := make([]string, 0, len(probe.Summary))
+	for _, summary := range probe.Summary {
+		if summary.TTL > last {
+			break
+		}
+		switch {
+		case summary.Received == 0:
+			hops = append(hops, SILENT_HOP)
+		case multipath:
+			addresses := append([]string{}, summary.Addresses...)
+			sort.Strings(addresses)
+			hops = append(hops, strings.Join(addresses, "|"))
+		default:
+			hops = append(hops, summary.Address.ValueOrZero())
+		}
+	}
+
+	if !reached {
+		for len(hops) > 0 && hops[len(hops)-1] == SILENT_HOP {
+			hops = hops[:len(hops)-1]
+		}
+	}
+	return hops, reached
+}
+
+func pathFingerprint(hops []string, reached bool) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%t", strings.Join(hops, ","), reached)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// divergeTTL is the first TTL where two paths differ, 0 if they don't. With ignoreSilent a hop
+// that didn't answer on either side matches anything, so a router dropping the odd probe
+// doesn't count as a new path.
+func divergeTTL(before, after []string, ignoreSilent bool) int {
+	for i := 0; i < len(before) && i < len(after); i++ {
+		if ignoreSilent && (before[i] == SILENT_HOP || after[i] == SILENT_HOP) {
+			continue
+		}
+		if before[i] != after[i] {
+			return i + 1
+		}
+	}
+	if len(before) != len(after) {
+		shorter := len(before)
+		if len(after) < shorter {
+			shorter = len(after)
+		}
+		return shorter + 1
+	}
+	return 0
+}
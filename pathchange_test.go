@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"testing"
+	"time"
+)
+
+// pathProbe builds a probe along addresses, "*" for a hop that didn't answer. The last
+// address answers as the destination when reached is set.
+func pathProbe(reached bool, addresses ...string) Probe {
+	hops := make([]ProbeResponse, 0, len(addresses))
+	for i, address := range addresses {
+		hop := ProbeResponse{TTL: i + 1}
+		if address != SILENT_HOP {
+			hop.Responded = true
+			hop.IP = null.StringFrom(address)
+			hop.HeaderDest = net.ParseIP("192.0.2.9")
+			if reached && i == len(addresses)-1 {
+				hop.HeaderDest = nil
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return Probe{Hops: hops, Summary: summarizeHops(hops), EndTime: time.Now()}
+}
+
+func TestPathTrackerDetectsChange(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewPathTracker()
+	target := ProbeTarget{Destination: "192.0.2.9"}
+
+	first, change := tracker.Observe(target, pathProbe(true, "10.0.0.1", "10.0.1.1", "192.0.2.9"))
+	assert.Nil(change, "nothing to compare the first probe to")
+
+	same, change := tracker.Observe(target, pathProbe(true, "10.0.0.1", "10.0.1.1", "192.0.2.9"))
+	assert.Nil(change)
+	assert.Equal(first, same, "same path same fingerprint")
+
+	_, change = tracker.Observe(target, pathProbe(true, "10.0.0.1", "10.0.2.1", "192.0.2.9"))
+	assert.NotNil(change)
+	assert.Equal(2, change.DivergeTTL)
+	assert.Equal([]string{"10.0.0.1", "10.0.1.1", "192.0.2.9"}, change.OldPath)
+	assert.Equal([]string{"10.0.0.1", "10.0.2.1", "192.0.2.9"}, change.NewPath)
+	assert.NotEqual(change.OldFingerprint, change.NewFingerprint)
+
+	_, change = tracker.Observe(target, pathProbe(false, "10.0.0.1", "10.0.2.1", SILENT_HOP, SILENT_HOP))
+	assert.NotNil(change, "destination going away is a change")
+	assert.False(change.NewReached)
+	assert.Equal([]string{"10.0.0.1", "10.0.2.1"}, change.NewPath, "trailing silence trimmed")
+	assert.Equal(3, change.DivergeTTL)
+}
+
+func TestPathTrackerIgnoresSilentHops(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewPathTracker()
+	strict := ProbeTarget{Destination: "192.0.2.9"}
+	lenient := ProbeTarget{Destination: "192.0.2.10", IgnoreSilentHops: true}
+
+	for _, target := range []ProbeTarget{strict, lenient} {
+		tracker.Observe(target, pathProbe(true, "10.0.0.1", "10.0.1.1", "192.0.2.9"))
+	}
+	_, strictChange := tracker.Observe(strict, pathProbe(true, "10.0.0.1", SILENT_HOP, "192.0.2.9"))
+	_, lenientChange := tracker.Observe(lenient, pathProbe(true, "10.0.0.1", SILENT_HOP, "192.0.2.9"))
+
+	assert.NotNil(strictChange)
+	assert.Nil(lenientChange, "a hop dropping a probe isn't a new path")
+
+	_, lenientChange = tracker.Observe(lenient, pathProbe(true, "10.0.0.1", "10.0.2.1", "192.0.2.9"))
+	assert.NotNil(lenientChange, "hop behind the silent TTL still remembered")
+}
+
+func TestPathTrackerPerAddress(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewPathTracker()
+	target := ProbeTarget{Destination: "anycast.example.net", AllAddresses: true}
+
+	east := pathProbe(true, "10.0.0.1", "10.0.1.1", "192.0.2.9")
+	east.ResolvedIP = "192.0.2.9"
+	west := pathProbe(true, "10.0.0.1", "10.0.2.1", "10.0.2.2", "192.0.2.9")
+	west.ResolvedIP = "198.51.100.9"
+
+	for i := 0; i < 2; i++ {
+		_, change := tracker.Observe(target, east)
+		assert.Nil(change)
+		_, change = tracker.Observe(target, west)
+		assert.Nil(change, "each address compared against its own path")
+	}
+
+	tracker.ForgetTarget(target.Destination)
+	_, change := tracker.Observe(target, west)
+	assert.Nil(change)
+}
+
+func TestDivergeTTL(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(0, divergeTTL([]string{"a", "b"}, []string{"a", "b"}, false))
+	assert.Equal(1, divergeTTL([]string{"a", "b"}, []string{"c", "b"}, false))
+	assert.Equal(3, divergeTTL([]string{"a", "b"}, []string{"a", "b", "c"}, false), "hop added")
+	assert.Equal(0, divergeTTL([]string{"a", "*"}, []string{"a", "b"}, true))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	// Smallest MTU every link has to carry, probes this size get through if anything does
+	PMTU_MIN_IPV4 = 68
+	PMTU_MIN_IPV6 = 1280
+
+	// Where probes start when the interface towards the target can't be found
+	PMTU_DEFAULT_MTU = 1500
+)
+
+func NewPMTUProbeExecutor(target ProbeTarget) ProbeExecutor {
+	return &PMTUProbeExecutor{target}
+}
+
+// PMTUProbeExecutor walks the path like UDP traceroute does, with probes that can't be
+// fragmented. They start out as big as our own interface allows and shrink to whatever each
+// hop lets through.
+type PMTUProbeExecutor struct {
+	ProbeTarget
+}
+
+// PMTUResult is what a path MTU probe found out. PathMTU is the largest probe the destination
+// answered, null if it never did.
+type PMTUResult struct {
+	PathMTU null.Int `json:"path_mtu"`
+	Hops    []HopMTU `json:"hops"`
+}
+
+// HopMTU is what's known about sizes at a single TTL. MTU is the largest probe that made it
+// there and NextHopMTU what the hop said it can send on, if it ever said a probe was too big.
+// BlackHole is set when bigger probes vanished on the way here without anyone saying so.
+type HopMTU struct {
+	TTL        int         `json:"ttl"`
+	IP         null.String `json:"ip"`
+	MTU        null.Int    `json:"mtu"`
+	NextHopMTU null.Int    `json:"next_hop_mtu"`
+	BlackHole  bool        `json:"black_hole"`
+}
+
+func (p *PMTUProbeExecutor) Execute(target string, port uint16, count int) ([]ProbeResponse, error) {
+	targetIP, addrErr := resolveTarget(target, p.AddressFamily)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+	target = targetIP.String()
+	if port == 0 {
+		port = UDP_BASE_PORT
+	}
+
+	// Every size goes out on the same flow, a load balancer sending sizes down different
+	// paths would have us blame the wrong hop.
+	source, reserveErr := reserveUDPPort(targetIP, port)
+	if reserveErr != nil {
+		return nil, reserveErr
+	}
+	defer source.Close()
+	sourceAddr := source.LocalAddr().(*net.UDPAddr)
+
+	log.Info("Starting path MTU probes to ", target)
+
+	send := func(ttl int, size int) ProbeResponse {
+		response := sendSizedUDPProbe(targetIP, sourceAddr, port, ttl, p.tos(), size)
+		// A hop that can't fit this size is only the end of the path for this size
+		if response.tooBig {
+			response.Unreachable = null.String{}
+		}
+		return response
+	}
+	hops := discoverPMTU(target, count, p.maxHops(), interfaceMTU(sourceAddr.IP), pmtuMinSize(targetIP), send)
+
+	log.Debug("probe complete to ", target)
+	return hops, nil
+}
+
+// pmtuSender sends a single probe of size bytes with the given TTL
+type pmtuSender func(ttl int, size int) ProbeResponse
+
+// discoverPMTU walks TTLs upwards like traceHops, sending count probes per TTL of the largest
+// size still thought to fit. A hop saying a size is too big has the rest of the path probed at
+// the MTU it gave. When a size vanishes without a word but the smallest one gets through, the
+// largest size that does is searched for, that's a black hole.
+func discoverPMTU(target string, count int, maxHops int, size int, minSize int, send pmtuSender) []ProbeResponse {
+	hops := make([]ProbeResponse, 0)
+	sendBatch := func(ttl int, size int) []ProbeResponse {
+		var probewg sync.WaitGroup
+		batch := ProbeBatch{hops: make([]ProbeResponse, 0, count)}
+		probewg.Add(count)
+		for i := 0; i < count; i++ {
+			go func() {
+				defer probewg.Done()
+				batch.Add(send(ttl, size))
+			}()
+		}
+		probewg.Wait()
+
+		hops = append(hops, batch.hops...)
+		return batch.hops
+	}
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		batch := sendBatch(ttl, size)
+		for !pmtuPassed(batch) && size > minSize {
+			if mtu, ok := smallestNextHopMTU(batch); ok && mtu < size {
+				size = mtu
+				if size < minSize {
+					size = minSize
+				}
+				batch = sendBatch(ttl, size)
+				continue
+			}
+
+			// Nothing we can use came back, find out whether anything gets through at all
+			small := sendBatch(ttl, minSize)
+			if !pmtuPassed(small) {
+				batch = small
+				break
+			}
+			// A hop rate limiting its ICMP looks just like one dropping big probes, the size gets
+			// another go before we go looking for a black hole.
+			batch = sendBatch(ttl, size)
+			if mtu, ok := smallestNextHopMTU(batch); pmtuPassed(batch) || ok && mtu < size {
+				continue
+			}
+			good, lost := minSize, size
+			batch = small
+			for lost-good > 1 {
+				middle := good + (lost-good)/2
+				if probe := sendBatch(ttl, middle); pmtuPassed(probe) {
+					good, batch = middle, probe
+				} else {
+					lost = middle
+				}
+			}
+			size = good
+		}
+
+		final := ProbeBatch{hops: batch}
+		if final.IsFinal(target) {
+			break
+		}
+	}
+
+	return hops
+}
+
+// pmtuPassed tells whether any of the probes got where they were going at their size
+func pmtuPassed(batch []ProbeResponse) bool {
+	for _, hop := range batch {
+		if hop.Responded && !hop.tooBig {
+			return true
+		}
+	}
+	return false
+}
+
+// smallestNextHopMTU is the smallest MTU any hop gave when saying a probe was too big. Some
+// old routers say so without giving one.
+func smallestNextHopMTU(batch []ProbeResponse) (int, bool) {
+	mtu := 0
+	for _, hop := range batch {
+		if hop.tooBig && hop.NextHopMTU.Valid && (mtu == 0 || int(hop.NextHopMTU.Int64) < mtu) {
+			mtu = int(hop.NextHopMTU.Int64)
+		}
+	}
+	return mtu, mtu > 0
+}
+
+// buildPMTUResult works out the MTU at every TTL from the probes discoverPMTU sent. Too big
+// comes from the hop in front of the link that's too small. The TTL before the probe that got
+// it passed the same size, so that's the hop a next hop MTU goes on.
+func buildPMTUResult(hops []ProbeResponse, target string) *PMTUResult {
+	byTTL := make(map[int][]ProbeResponse)
+	ttls := make([]int, 0)
+	for _, hop := range hops {
+		if _, ok := byTTL[hop.TTL]; !ok {
+			ttls = append(ttls, hop.TTL)
+		}
+		byTTL[hop.TTL] = append(byTTL[hop.TTL], hop)
+	}
+	sort.Ints(ttls)
+
+	result := &PMTUResult{Hops: make([]HopMTU, 0, len(ttls))}
+	hopIndex := make(map[int]int)
+	tooBig := make([]ProbeResponse, 0)
+	for _, ttl := range ttls {
+		summary := HopMTU{TTL: ttl}
+		largestLost := int64(0)
+		for _, hop := range byTTL[ttl] {
+			switch {
+			case hop.tooBig:
+				tooBig = append(tooBig, hop)
+			case hop.Responded:
+				summary.IP = hop.IP
+				if !summary.MTU.Valid || hop.Size.Int64 > summary.MTU.Int64 {
+					summary.MTU = hop.Size
+				}
+			case hop.Size.Int64 > largestLost:
+				largestLost = hop.Size.Int64
+			}
+		}
+		summary.BlackHole = summary.MTU.Valid && largestLost > summary.MTU.Int64
+
+		if summary.IP.String == target && !result.PathMTU.Valid {
+			result.PathMTU = summary.MTU
+		}
+		hopIndex[ttl] = len(result.Hops)
+		result.Hops = append(result.Hops, summary)
+	}
+
+	for _, hop := range tooBig {
+		if !hop.NextHopMTU.Valid {
+			continue
+		}
+		i, ok := hopIndex[hop.TTL-1]
+		if !ok {
+			i = hopIndex[hop.TTL]
+		}
+		current := result.Hops[i].NextHopMTU
+		if !current.Valid || hop.NextHopMTU.Int64 < current.Int64 {
+			result.Hops[i].NextHopMTU = hop.NextHopMTU
+		}
+	}
+
+	return result
+}
+
+// interfaceMTU is the MTU of the interface ip is on, no probe can go out bigger than that
+func interfaceMTU(ip net.IP) int {
+	interfaces, interfacesErr := net.Interfaces()
+	if interfacesErr != nil {
+		return PMTU_DEFAULT_MTU
+	}
+	for _, iface := range interfaces {
+		addrs, addrErr := iface.Addrs()
+		if addrErr != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				// Loopback goes past what the IP total length field can hold
+				if iface.MTU > 0xffff {
+					return 0xffff
+				}
+				return iface.MTU
+			}
+		}
+	}
+	return PMTU_DEFAULT_MTU
+}
+
+// pmtuMinSize is the smallest MTU a link towards ip is allowed to have
+func pmtuMinSize(ip net.IP) int {
+	if ip.To4() != nil {
+		return PMTU_MIN_IPV4
+	}
+	return PMTU_MIN_IPV6
+}
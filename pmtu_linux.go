@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// enablePMTUProbing has everything sent on conn go out unfragmented with DF set, sized against
+// the interface MTU rather than whatever the kernel learned about the path. Path MTU probes
+// need to see how far a size gets, not have the kernel refuse or fragment it for them.
+func enablePMTUProbing(conn *net.IPConn, ip net.IP) error {
+	rawConn, rawErr := conn.SyscallConn()
+	if rawErr != nil {
+		return rawErr
+	}
+
+	var sockErr error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		if ip.To4() != nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Keeping the kernel from fragmenting probes is only wired up on linux, everywhere else path
+// MTU probes can't be sent.
+func enablePMTUProbing(conn *net.IPConn, ip net.IP) error {
+	return fmt.Errorf("path MTU probes not supported on this platform")
+}
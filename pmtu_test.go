@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"testing"
+)
+
+// fakePMTUPath answers probes the way a path of hops with the given MTUs onwards would. A
+// negative MTU is a hop that drops anything bigger without saying so, a 0 one never answers.
+func fakePMTUPath(target string, mtus []int) pmtuSender {
+	return func(ttl int, size int) ProbeResponse {
+		response := ProbeResponse{TTL: ttl, Size: null.IntFrom(int64(size))}
+		for i := 1; i < ttl && i <= len(mtus); i++ {
+			mtu := mtus[i-1]
+			if mtu < 0 && size > -mtu {
+				return response
+			}
+			if mtu > 0 && size > mtu {
+				response.Responded, response.tooBig = true, true
+				response.IP = null.StringFrom(fmt.Sprintf("10.0.%d.1", i))
+				response.NextHopMTU = null.IntFrom(int64(mtu))
+				return response
+			}
+		}
+		if ttl <= len(mtus) && mtus[ttl-1] == 0 {
+			return response
+		}
+
+		response.Responded = true
+		response.IP = null.StringFrom(fmt.Sprintf("10.0.%d.1", ttl))
+		if ttl > len(mtus) {
+			response.IP = null.StringFrom(target)
+		}
+		return response
+	}
+}
+
+func TestDiscoverPMTU(t *testing.T) {
+	assert := assert.New(t)
+	target := "198.51.100.7"
+
+	// Too big from hop 2, a silent hop 3 and a black hole after hop 4
+	hops := discoverPMTU(target, 1, 10, 1500, PMTU_MIN_IPV4, fakePMTUPath(target, []int{9000, 1400, 0, -1380}))
+	result := buildPMTUResult(hops, target)
+
+	assert.Equal(null.IntFrom(1380), result.PathMTU)
+	assert.Equal(5, len(result.Hops), "stops once the target answers")
+	assert.Equal(HopMTU{TTL: 1, IP: null.StringFrom("10.0.1.1"), MTU: null.IntFrom(1500)}, result.Hops[0])
+	assert.Equal(HopMTU{TTL: 2, IP: null.StringFrom("10.0.2.1"), MTU: null.IntFrom(1500), NextHopMTU: null.IntFrom(1400)}, result.Hops[1])
+	assert.Equal(HopMTU{TTL: 3}, result.Hops[2], "silent hop")
+	assert.Equal(null.IntFrom(1400), result.Hops[3].MTU)
+	assert.False(result.Hops[3].BlackHole)
+	assert.Equal(HopMTU{TTL: 5, IP: null.StringFrom(target), MTU: null.IntFrom(1380), BlackHole: true}, result.Hops[4])
+}
+
+func TestDiscoverPMTUUnreached(t *testing.T) {
+	assert := assert.New(t)
+	target := "198.51.100.7"
+
+	hops := discoverPMTU(target, 2, 3, 1500, PMTU_MIN_IPV4, fakePMTUPath(target, []int{1500, 1500, 1500, 1500}))
+	result := buildPMTUResult(hops, target)
+
+	assert.False(result.PathMTU.Valid, "destination never answered")
+	assert.Equal(3, len(result.Hops))
+	assert.Equal(6, len(hops), "count probes per TTL")
+}
+
+func TestDiscoverPMTURetriesLoss(t *testing.T) {
+	assert := assert.New(t)
+	target := "198.51.100.7"
+
+	path := fakePMTUPath(target, []int{1500})
+	lost := false
+	send := func(ttl int, size int) ProbeResponse {
+		if ttl == 2 && !lost {
+			lost = true
+			return ProbeResponse{TTL: ttl, Size: null.IntFrom(int64(size))}
+		}
+		return path(ttl, size)
+	}
+	result := buildPMTUResult(discoverPMTU(target, 1, 10, 1500, PMTU_MIN_IPV4, send), target)
+
+	assert.Equal(null.IntFrom(1500), result.PathMTU, "a lost probe isn't a black hole")
+	assert.False(result.Hops[1].BlackHole)
+}
@@ -1,34 +1,124 @@
 package main
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/guregu/null.v4"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var probeTypeMap = map[string]ProbeExecutorFactory{
-	"tcp": NewTCPProbeExecutor,
-	"udp": NewUDPProbeExecutor,
-	// TODO: ICMP
+	"tcp":  NewTCPProbeExecutor,
+	"udp":  NewUDPProbeExecutor,
+	"icmp": NewICMPProbeExecutor,
+	"pmtu": NewPMTUProbeExecutor,
 }
 
+// Probe is one run towards one address of a target. Target is the destination as configured,
+// hostname or not, and ResolvedIP the address it was probed at.
 type Probe struct {
-	Target    string          `json:"target"`
-	StartTime time.Time       `json:"start_time"`
-	EndTime   time.Time       `json:"end_time"`
-	Hops      []ProbeResponse `json:"hops"`
+	Target     string          `json:"target"`
+	ResolvedIP string          `json:"resolved_ip"`
+	StartTime  time.Time       `json:"start_time"`
+	EndTime    time.Time       `json:"end_time"`
+	Hops       []ProbeResponse `json:"hops"`
+	Summary    []HopSummary    `json:"summary"`
+	Cycles     int             `json:"cycles,omitempty"`
+	StopReason string          `json:"stop_reason,omitempty"`
+	Graph      *ProbeGraph     `json:"graph,omitempty"`
+	PMTU       *PMTUResult     `json:"pmtu,omitempty"`
+
+	PathFingerprint string      `json:"path_fingerprint"`
+	PathChange      *PathChange `json:"path_change,omitempty"`
 }
 
 type ProbeResponse struct {
-	IP           null.String `json:"ip"`
-	DNSName      null.String `json:"dns_name"`
-	Time         int64       `json:"response_time"`
-	Responded    bool        `json:"responded"`
-	TTL          int         `json:"ttl"`
-	HeaderSource net.IP      `json:"-"`
-	HeaderDest   net.IP      `json:"-"`
+	IP           null.String   `json:"ip"`
+	DNSName      null.String   `json:"dns_name"`
+	DNSNames     []string      `json:"dns_names"`
+	DNSConfirmed bool          `json:"dns_confirmed"`
+	Time         int64         `json:"response_time"`
+	TimeMicros   int64         `json:"response_time_us"`
+	Responded    bool          `json:"responded"`
+	TTL          int           `json:"ttl"`
+	FlowID       null.Int      `json:"flow_id"`
+	ICMPType     null.Int      `json:"icmp_type"`
+	ICMPCode     null.Int      `json:"icmp_code"`
+	TCPFlags     null.String   `json:"tcp_flags"`
+	ReplyTTL     null.Int      `json:"reply_ttl"`
+	ReturnHops   null.Int      `json:"return_hops"`
+	Unreachable  null.String   `json:"unreachable"`
+	QuotedTOS    null.Int      `json:"quoted_tos"`
+	TOSMatched   null.Bool     `json:"tos_matched"`
+	Size         null.Int      `json:"size"`
+	NextHopMTU   null.Int      `json:"next_hop_mtu"`
+	Modified     []string      `json:"modified,omitempty"`
+	QuoteChanges []string      `json:"quote_changes,omitempty"`
+	MPLSLabels   []MPLSLabel   `json:"mpls_labels,omitempty"`
+	Interface    *HopInterface `json:"interface,omitempty"`
+	HeaderSource net.IP        `json:"-"`
+	HeaderDest   net.IP        `json:"-"`
+
+	// whether the hop quoted our probe back, Modified is empty rather than unknown if it did
+	quoted bool
+	// whether the hop said the probe was too big for its next hop
+	tooBig bool
+	// whether the hop said the probe ran out of TTL, and the TTL it quoted back
+	timeExceeded bool
+	quotedTTL    int
+	// when the probe went out, probes of a TTL finish in whatever order their goroutines do
+	sentAt time.Time
+}
+
+// setICMPDetails copies whatever an ICMP response told us about the hop besides who sent it,
+// sent being the probe it answered.
+func (r *ProbeResponse) setICMPDetails(sent SentPacket, response ICMPResponse) {
+	// Echo replies do not quote our original header, only errors from transit hops do
+	if response.OriginalHeader != nil {
+		r.HeaderSource = response.OriginalHeader.Src
+		r.HeaderDest = response.OriginalHeader.Dst
+		// Only a hop saying the probe ran out of TTL is known to be as far as the TTL it was
+		// sent with, the rest gets checked by markTTLRewrites once we know how far away it is.
+		distance := 0
+		if response.Response != nil && timeExceeded(response.Response) {
+			distance = sent.TTL
+			r.timeExceeded = true
+		}
+		r.Modified = quoteModifications(sent, response.OriginalHeader, distance)
+		r.quotedTTL = response.OriginalHeader.TTL
+		r.QuotedTOS = null.IntFrom(int64(response.OriginalHeader.TOS))
+		r.TOSMatched = null.BoolFrom(response.OriginalHeader.TOS == sent.TOS)
+		r.quoted = true
+	}
+	r.MPLSLabels = response.MPLSLabels
+	r.Interface = response.Interface
+	if response.MTU > 0 {
+		r.NextHopMTU = null.IntFrom(int64(response.MTU))
+	}
+
+	if response.Response != nil {
+		r.ICMPType = null.IntFrom(int64(icmpTypeNumber(response.Response.Type)))
+		r.ICMPCode = null.IntFrom(int64(response.Response.Code))
+		r.tooBig = packetTooBig(response.Response)
+		if reason := unreachableReason(response.Response); reason != "" {
+			r.Unreachable = null.StringFrom(reason)
+		}
+	}
+	r.setReplyTTL(response.ReplyTTL)
+}
+
+// setReplyTTL records the TTL a reply arrived with and how far it came to get here
+func (r *ProbeResponse) setReplyTTL(replyTTL int) {
+	if replyTTL <= 0 {
+		return
+	}
+	r.ReplyTTL = null.IntFrom(int64(replyTTL))
+	if hops := returnHops(replyTTL); hops > 0 {
+		r.ReturnHops = null.IntFrom(int64(hops))
+	}
 }
 
 // This exists so we can fire off all probes for any given TTL and concurrently write back
@@ -45,9 +135,11 @@ func (b *ProbeBatch) Add(response ProbeResponse) {
 	b.Unlock()
 }
 
+// IsFinal tells whether there's any point going past this TTL, which there isn't once the
+// target answered or a hop told us it can't get there.
 func (b *ProbeBatch) IsFinal(target string) bool {
 	for _, hop := range b.hops {
-		if hop.IP.String == target {
+		if hop.IP.String == target || hop.Unreachable.Valid {
 			return true
 		}
 	}
@@ -60,57 +152,189 @@ type ProbeExecutor interface {
 
 type ProbeExecutorFactory func(target ProbeTarget) ProbeExecutor
 
+// FlowProber is implemented by executors that can pin probes to a flow, so the path a probe
+// takes through ECMP load balancers depends only on the flow it was sent on. OpenFlows
+// reserves whatever the executor needs for a run towards targetIP, closeFlows releases it.
+type FlowProber interface {
+	OpenFlows(targetIP net.IP, port uint16) (send flowSender, closeFlows func(), err error)
+}
+
+// flowSender sends a single probe with the given TTL on the given flow
+type flowSender func(ttl int, flow int) ProbeResponse
+
+// newProbeExecutor picks the executor for a target based on its type, wrapped in whatever
+// probing mode the target asks for.
+func newProbeExecutor(target ProbeTarget) (ProbeExecutor, error) {
+	executorFactory, ok := probeTypeMap[target.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported target protocol: %s", target.Type)
+	}
+	executor := executorFactory(target)
+
+	if target.MDA {
+		flowProber, ok := executor.(FlowProber)
+		if !ok {
+			return nil, fmt.Errorf("MDA is not supported for %s probes", target.Type)
+		}
+		executor = NewMDAProbeExecutor(target, flowProber)
+	}
+
+	return executor, nil
+}
+
+// hopSender sends a single probe with the given TTL and returns whatever came back for it.
+// attempt is the index of the probe within the current TTL batch.
+type hopSender func(ttl int, attempt int) ProbeResponse
+
+// traceHops fires off count probes per TTL using send, walking TTLs upwards until the target
+// responds or we hit maxHops. Every executor shares this loop, only packet crafting differs.
+func traceHops(target string, count int, maxHops int, send hopSender) []ProbeResponse {
+	currentTTL := 1
+	hops := make([]ProbeResponse, 0)
+	for currentTTL <= maxHops {
+		var probewg sync.WaitGroup
+		batch := ProbeBatch{hops: make([]ProbeResponse, 0, count)}
+		probewg.Add(count)
+
+		for i := 0; i < count; i++ {
+			go func(ttl int, attempt int) {
+				defer probewg.Done()
+				batch.Add(send(ttl, attempt))
+			}(currentTTL, i)
+		}
+		probewg.Wait()
+
+		hops = append(hops, batch.hops...)
+		currentTTL++
+		if batch.IsFinal(target) {
+			break
+		}
+	}
+
+	return hops
+}
+
 func updateDNSName(hop *ProbeResponse, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	if !hop.IP.IsZero() {
-		// This should return multiple DNS names but we are only
-		// expecting 1 in the data model on the server side.
-		// TODO: support multiple reverse lookup records?
-		names, lookupErr := net.LookupAddr(hop.IP.ValueOrZero())
-		if lookupErr != nil {
-			log.Debug("Reverse lookup failed for ", hop.IP)
-		}
+		// dns_name stays the first name, which is all the server side data model expects.
+		// Every name and whether any of them point back at the hop come alongside it.
+		name := rdnsCache.Lookup(hop.IP.ValueOrZero())
 
-		log.Debug("Reverse lookup results: ", names)
-		if len(names) > 0 {
-			log.Debug(null.StringFrom(names[0]))
-			hop.DNSName = null.StringFrom(names[0])
+		log.Debug("Reverse lookup results: ", name.Names)
+		if len(name.Names) > 0 {
+			hop.DNSName = null.StringFrom(name.Names[0])
+			hop.DNSNames = name.Names
+			hop.DNSConfirmed = name.Confirmed
 		}
 	}
 }
 
 func probeHandler(target ProbeTarget) {
-	probe := Probe{
-		Target:    target.Destination,
-		StartTime: time.Now(),
-		Hops:      make([]ProbeResponse, 0),
+	// Targets from voyager server haven't been through loadTargetsFile
+	if invalidErr := target.validate(); invalidErr != nil {
+		log.WithFields(log.Fields{"target": target.Destination}).Warn(invalidErr)
+		return
 	}
 
-	// TODO: better factory-ish thing here
-	executorFactory, ok := probeTypeMap[target.Type]
+	// Continuous targets are probed all the time in the background, all that happens on the
+	// interval is reporting on them.
+	if target.Continuous {
+		if probe, ok := continuousProbes.Snapshot(target); ok {
+			finishProbes(target, []Probe{probe})
+		}
+		return
+	}
+	continuousProbes.Stop(target.Destination)
+
+	done, ok := scheduler.StartRun(target.Destination)
 	if !ok {
-		log.WithFields(log.Fields{"target": target}).Warn("Unsupported target protocol")
+		log.WithFields(log.Fields{"target": target.Destination}).Warn("Previous run still going and another waiting on it, skipping this one")
+		atomic.AddUint64(&skippedRuns, 1)
 		return
 	}
-	executor := executorFactory(target)
-	hops, hopsErr := executor.Execute(target.Destination, target.Port, target.ProbeCount)
-	if hopsErr != nil {
-		log.Warn("Error executing UDP probe: ", hopsErr)
+	defer done()
+
+	addresses, addrErr := targetAddresses(target)
+	if addrErr != nil {
+		log.WithFields(log.Fields{"target": target}).Warn(addrErr)
 		return
 	}
+
+	probes := make([]Probe, 0, len(addresses))
+	for _, address := range addresses {
+		probe, probeErr := runProbe(target, address)
+		if probeErr != nil {
+			log.WithFields(log.Fields{"target": target, "address": address}).Warn(probeErr)
+			continue
+		}
+		probes = append(probes, probe)
+	}
+
+	finishProbes(target, probes)
+}
+
+// runProbe does a single run of whatever probe the target asks for towards one of its addresses
+func runProbe(target ProbeTarget, address net.IP) (Probe, error) {
+	probe := Probe{
+		Target:     target.Destination,
+		ResolvedIP: address.String(),
+		StartTime:  time.Now(),
+		Hops:       make([]ProbeResponse, 0),
+	}
+
+	executor, executorErr := newProbeExecutor(target)
+	if executorErr != nil {
+		return probe, executorErr
+	}
+	hops, hopsErr := executor.Execute(address.String(), target.Port, target.ProbeCount)
+	if hopsErr != nil {
+		return probe, fmt.Errorf("Error executing %s probe: %s", target.Type, hopsErr)
+	}
+	markQuoteChanges(hops)
 	probe.Hops = hops
+	probe.Summary = summarizeHops(hops)
+	probe.StopReason = stopReason(hops)
+	if target.MDA {
+		probe.Graph = buildProbeGraph(probe.Hops)
+	}
+	if target.Type == "pmtu" {
+		probe.PMTU = buildPMTUResult(probe.Hops, probe.ResolvedIP)
+	}
+
+	return probe, nil
+}
 
+// finishProbes looks up names for every hop and sends the probes on their way. probes is every
+// address of the target that was probed this interval.
+func finishProbes(target ProbeTarget, probes []Probe) {
+	for i := range probes {
+		probe := &probes[i]
+		if !target.DisableRDNS {
+			resolveHopNames(probe.Hops)
+		}
+
+		if probe.EndTime.IsZero() {
+			probe.EndTime = time.Now()
+		}
+		probe.PathFingerprint, probe.PathChange = pathTracker.Observe(target, *probe)
+	}
+
+	metrics.RecordProbes(target, probes)
+	for _, probe := range probes {
+		go emitResult(probe)
+	}
+}
+
+func resolveHopNames(hops []ProbeResponse) {
 	var wg sync.WaitGroup
-	wg.Add(len(probe.Hops))
+	wg.Add(len(hops))
 
 	// range will make a copy of each element and pass by value, but we want the pointer
 	// so we will do this the old school way.
-	for i := 0; i < len(probe.Hops); i++ {
-		go updateDNSName(&probe.Hops[i], &wg)
+	for i := 0; i < len(hops); i++ {
+		go updateDNSName(&hops[i], &wg)
 	}
 	wg.Wait()
-
-	probe.EndTime = time.Now()
-	go emitProbeResults(probe)
 }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/net/ipv4"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Fields of our probes that hops along the way have been seen rewriting, as reported in
+// ProbeResponse.Modified and ProbeResponse.QuoteChanges
+const (
+	FIELD_SOURCE_ADDR = "src_addr"
+	FIELD_SOURCE_PORT = "src_port"
+	FIELD_DEST_PORT   = "dst_port"
+	FIELD_DSCP        = "dscp"
+	FIELD_ECN         = "ecn"
+	FIELD_IP_ID       = "ip_id"
+	FIELD_TTL         = "ttl"
+	FIELD_DF          = "df"
+	FIELD_TCP_SEQ     = "tcp_seq"
+	FIELD_TCP_WINDOW  = "tcp_window"
+	FIELD_TCP_OPTIONS = "tcp_options"
+	FIELD_CHECKSUM    = "checksum"
+)
+
+// SentPacket is what a probe looked like when it left, to hold the quote of it that comes back
+// in ICMP errors up against. IPHeader is set when we wrote the IPv4 header ourselves, the IP
+// ID and DF flag are only known if we did. Source is nil when the kernel picked it.
+type SentPacket struct {
+	Source    net.IP
+	TTL       int
+	TOS       int
+	IPHeader  bool
+	IPID      int
+	DF        bool
+	Protocol  int
+	Transport []byte
+}
+
+// prepareProbeConn gets a raw socket ready for writeProbe right after it's created, so none of
+// the syscalls end up between taking the send time and the probe leaving. IPv4 probes go out
+// in a header of our own where the platform lets us, anything else has TTL and TOS set on the
+// socket for the kernel to use.
+func prepareProbeConn(conn *net.IPConn, targetIP net.IP, ttl int, tos int) (headerIncluded bool, err error) {
+	if targetIP.To4() != nil && enableHeaderIncluded(conn) == nil {
+		return true, nil
+	}
+	setConnTTL(conn, targetIP, ttl)
+	return false, setConnTOS(conn, targetIP, tos)
+}
+
+// writeProbe sends transport towards targetIP on a conn from prepareProbeConn, marked with tos.
+// The time returned is taken right before the write, with the packet already built.
+func writeProbe(conn *net.IPConn, headerIncluded bool, source net.IP, targetIP net.IP, protocol int, ttl int, tos int, df bool, transport []byte) (SentPacket, time.Time, error) {
+	sent, packet, buildErr := buildProbePacket(headerIncluded, source, targetIP, protocol, ttl, tos, df, transport)
+	if buildErr != nil {
+		return sent, time.Time{}, buildErr
+	}
+
+	sentTime := time.Now()
+	_, writeErr := conn.Write(packet)
+	return sent, sentTime, writeErr
+}
+
+// buildProbePacket puts an IPv4 header in front of transport if we're writing our own. DF is
+// only set when df asks for it, probes are otherwise free to be fragmented the way anything
+// else the kernel sends would be.
+func buildProbePacket(headerIncluded bool, source net.IP, targetIP net.IP, protocol int, ttl int, tos int, df bool, transport []byte) (SentPacket, []byte, error) {
+	sent := SentPacket{Source: source, TTL: ttl, TOS: tos, Protocol: protocol, Transport: transport}
+	if !headerIncluded {
+		return sent, transport, nil
+	}
+
+	header := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TOS:      sent.TOS,
+		TotalLen: ipv4.HeaderLen + len(transport),
+		// 0 would have the kernel pick one after all
+		ID:       1 + rand.Intn(0xffff),
+		TTL:      ttl,
+		Protocol: protocol,
+		Src:      source,
+		Dst:      targetIP,
+	}
+	if df {
+		header.Flags = ipv4.DontFragment
+	}
+	headerBytes, marshalErr := header.Marshal()
+	if marshalErr != nil {
+		return sent, nil, marshalErr
+	}
+	sent.IPHeader, sent.IPID, sent.DF = true, header.ID, df
+	return sent, append(headerBytes, transport...), nil
+}
+
+// quoteModifications lists the fields that differ between what we sent and the quote of it a
+// hop sent back. Only what's in both gets compared, hops quote anywhere from 8 bytes of the
+// transport header to the whole packet. distance is how many hops away the hop that quoted it
+// is, 0 if that isn't known.
+func quoteModifications(sent SentPacket, quoted *QuotedHeader, distance int) []string {
+	modified := make([]string, 0)
+	if sent.Source != nil && !sent.Source.Equal(quoted.Src) {
+		modified = append(modified, FIELD_SOURCE_ADDR)
+	}
+	if sent.TOS>>2 != quoted.TOS>>2 {
+		modified = append(modified, FIELD_DSCP)
+	}
+	if sent.TOS&0x03 != quoted.TOS&0x03 {
+		modified = append(modified, FIELD_ECN)
+	}
+	if ttlRewritten(sent.TTL, quoted.TTL, distance) {
+		modified = append(modified, FIELD_TTL)
+	}
+	if sent.IPHeader && quoted.Version == ipv4.Version {
+		if sent.IPID != quoted.ID {
+			modified = append(modified, FIELD_IP_ID)
+		}
+		if sent.DF != quoted.DF {
+			modified = append(modified, FIELD_DF)
+		}
+	}
+
+	changed := func(start, end int) bool {
+		if len(sent.Transport) < end || len(quoted.Transport) < end {
+			return false
+		}
+		return !bytes.Equal(sent.Transport[start:end], quoted.Transport[start:end])
+	}
+	switch sent.Protocol {
+	case protocolTCP:
+		if changed(0, 2) {
+			modified = append(modified, FIELD_SOURCE_PORT)
+		}
+		if changed(2, 4) {
+			modified = append(modified, FIELD_DEST_PORT)
+		}
+		if changed(4, 8) {
+			modified = append(modified, FIELD_TCP_SEQ)
+		}
+		if changed(14, 16) {
+			modified = append(modified, FIELD_TCP_WINDOW)
+		}
+		if changed(16, 18) {
+			modified = append(modified, FIELD_CHECKSUM)
+		}
+		if tcpOptionsChanged(sent.Transport, quoted.Transport) {
+			modified = append(modified, FIELD_TCP_OPTIONS)
+		}
+	case protocolUDP:
+		if changed(0, 2) {
+			modified = append(modified, FIELD_SOURCE_PORT)
+		}
+		if changed(2, 4) {
+			modified = append(modified, FIELD_DEST_PORT)
+		}
+		if changed(6, 8) {
+			modified = append(modified, FIELD_CHECKSUM)
+		}
+	case protocolICMP:
+		// The kernel fills in ICMPv6 checksums, only ours for IPv4 are known
+		if changed(2, 4) {
+			modified = append(modified, FIELD_CHECKSUM)
+		}
+	}
+	return modified
+}
+
+// ttlRewritten tells whether a quoted TTL is more than every hop on the way decrementing it
+// leaves. The hop that quotes it sees our probe with sent-distance+1 left, some quote it before
+// decrementing and some after, so for Time Exceeded that's always 1. Without a distance all
+// that's certain is it can't have gone up.
+func ttlRewritten(sent int, quoted int, distance int) bool {
+	if sent == 0 {
+		return false
+	}
+	if distance > 0 {
+		return quoted > sent-distance+1
+	}
+	return quoted > sent
+}
+
+// tcpOptionsChanged compares the options of two TCP headers, as far as the quote goes. A
+// different data offset alone means options were added or stripped.
+func tcpOptionsChanged(sent []byte, quoted []byte) bool {
+	if len(sent) < 13 || len(quoted) < 13 {
+		return false
+	}
+	sentLen, quotedLen := int(sent[12]>>4)*4, int(quoted[12]>>4)*4
+	if sentLen != quotedLen {
+		return true
+	}
+	if len(sent) < sentLen || len(quoted) < quotedLen {
+		return false
+	}
+	return !bytes.Equal(sent[20:sentLen], quoted[20:quotedLen])
+}
+
+// markTTLRewrites checks the TTLs quoted by errors other than Time Exceeded now the whole run
+// is in. Those can come from further along than the hop the probe ran out at, the first TTL a
+// hop answered at is how far away it is.
+func markTTLRewrites(hops []ProbeResponse) {
+	distances := make(map[string]int)
+	for _, hop := range hops {
+		if !hop.Responded || !hop.IP.Valid {
+			continue
+		}
+		if distance, ok := distances[hop.IP.String]; !ok || hop.TTL < distance {
+			distances[hop.IP.String] = hop.TTL
+		}
+	}
+
+	for i := range hops {
+		hop := &hops[i]
+		if !hop.quoted || hop.timeExceeded || !hop.IP.Valid {
+			continue
+		}
+		if !ttlRewritten(hop.TTL, hop.quotedTTL, distances[hop.IP.String]) {
+			continue
+		}
+		marked := false
+		for _, field := range hop.Modified {
+			marked = marked || field == FIELD_TTL
+		}
+		if !marked {
+			hop.Modified = append(hop.Modified, FIELD_TTL)
+		}
+	}
+}
+
+// markQuoteChanges works out what changed about our probes between the previous hop and each
+// hop, from what every hop says was modified since they left us. The first hop to show a
+// modification is the one doing it, or the one right behind it. Probes on a flow are compared
+// with their own flow, flowless ones with every probe of the TTL before.
+func markQuoteChanges(hops []ProbeResponse) {
+	markTTLRewrites(hops)
+
+	order := make([]int, len(hops))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return hops[order[i]].TTL < hops[order[j]].TTL })
+
+	before := make(map[int64]map[string]bool)
+	current := make(map[int64]map[string]bool)
+	currentTTL := 0
+	for _, i := range order {
+		hop := &hops[i]
+		if !hop.quoted {
+			continue
+		}
+		if hop.TTL != currentTTL {
+			for flow, fields := range current {
+				before[flow] = fields
+			}
+			current = make(map[int64]map[string]bool)
+			currentTTL = hop.TTL
+		}
+
+		flow := int64(-1)
+		if hop.FlowID.Valid {
+			flow = hop.FlowID.Int64
+		}
+		hop.QuoteChanges = make([]string, 0)
+		for _, field := range hop.Modified {
+			if !before[flow][field] {
+				hop.QuoteChanges = append(hop.QuoteChanges, field)
+			}
+		}
+
+		if current[flow] == nil {
+			current[flow] = make(map[string]bool)
+		}
+		for _, field := range hop.Modified {
+			current[flow][field] = true
+		}
+	}
+}
+
+// quotedIPv4Flags pulls the DF bit out of an IPv4 header. ipv4.ParseHeader takes the fragment
+// field to be in host byte order on some BSDs, which a quote never is.
+func quotedIPv4Flags(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	return binary.BigEndian.Uint16(header[6:8])&0x4000 != 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"testing"
+)
+
+func TestQuoteModifications(t *testing.T) {
+	assert := assert.New(t)
+	source := net.ParseIP("192.0.2.2")
+	datagram := craftUDPDatagram(source, net.ParseIP("198.51.100.7"), 40000, 33434, 4242)
+	sent := SentPacket{Source: source, TTL: 5, IPHeader: true, IPID: 77, DF: true, Protocol: protocolUDP, Transport: datagram}
+
+	quoted := &QuotedHeader{Version: ipv4.Version, Src: source, TTL: 1, ID: 77, DF: true, Transport: append([]byte{}, datagram[:8]...)}
+	assert.Equal([]string{}, quoteModifications(sent, quoted, 0), "untouched on the way")
+
+	// A NAT rewrites source address and port, and the checksum with them
+	nat := *quoted
+	nat.Src = net.ParseIP("203.0.113.1")
+	nat.Transport = craftUDPDatagram(nat.Src, net.ParseIP("198.51.100.7"), 1025, 33434, 4242)[:8]
+	nat.Transport[6], nat.Transport[7] = 0x12, 0x34
+	assert.Equal([]string{FIELD_SOURCE_ADDR, FIELD_SOURCE_PORT, FIELD_CHECKSUM}, quoteModifications(sent, &nat, 0))
+
+	bleached := *quoted
+	bleached.TOS, bleached.TTL, bleached.ID, bleached.DF = 0x01, 3, 78, false
+	sent.TOS = 0xb8
+	assert.Equal([]string{FIELD_DSCP, FIELD_ECN, FIELD_TTL, FIELD_IP_ID, FIELD_DF}, quoteModifications(sent, &bleached, 5))
+}
+
+func TestQuoteModificationsTCP(t *testing.T) {
+	assert := assert.New(t)
+	source := net.ParseIP("192.0.2.2")
+	segment := craftTCPSYNHeader(source, net.ParseIP("198.51.100.7"), 40000, 443, 4242)
+	sent := SentPacket{Source: source, Protocol: protocolTCP, Transport: segment}
+
+	rewritten := append([]byte{}, segment...)
+	rewritten[4], rewritten[15] = 0xaa, 0xff
+	quoted := &QuotedHeader{Src: source, TTL: 0, Transport: rewritten}
+	assert.Equal([]string{FIELD_TCP_SEQ, FIELD_TCP_WINDOW}, quoteModifications(sent, quoted, 0), "checksum wasn't fixed up")
+
+	// MSS option added by a middlebox
+	withMSS := append(append([]byte{}, segment...), 2, 4, 0x05, 0xb4)
+	withMSS[12] = 6 << 4
+	quoted = &QuotedHeader{Src: source, Transport: withMSS}
+	assert.Equal([]string{FIELD_TCP_OPTIONS}, quoteModifications(sent, quoted, 0))
+
+	// Only 8 bytes quoted, nothing past the sequence number to compare
+	quoted = &QuotedHeader{Src: source, Transport: segment[:8]}
+	assert.Equal([]string{}, quoteModifications(sent, quoted, 0))
+}
+
+func TestSetICMPDetailsTOS(t *testing.T) {
+	assert := assert.New(t)
+	target := ProbeTarget{DSCP: 46, ECN: 2}
+	sent := SentPacket{TOS: target.tos(), Protocol: protocolUDP}
+	assert.Equal(0xba, sent.TOS)
+
+	var kept ProbeResponse
+	kept.setICMPDetails(sent, ICMPResponse{OriginalHeader: &QuotedHeader{TOS: 0xba, TTL: 1}})
+	assert.Equal(null.IntFrom(0xba), kept.QuotedTOS)
+	assert.Equal(null.BoolFrom(true), kept.TOSMatched)
+
+	var bleached ProbeResponse
+	bleached.setICMPDetails(sent, ICMPResponse{OriginalHeader: &QuotedHeader{TOS: 0x02, TTL: 1}})
+	assert.Equal(null.BoolFrom(false), bleached.TOSMatched)
+	assert.Equal([]string{FIELD_DSCP}, bleached.Modified)
+
+	// Echo replies don't quote anything to compare against
+	var reply ProbeResponse
+	reply.setICMPDetails(sent, ICMPResponse{})
+	assert.False(reply.TOSMatched.Valid)
+}
+
+func TestMarkQuoteChanges(t *testing.T) {
+	assert := assert.New(t)
+	hops := []ProbeResponse{
+		{TTL: 3, quoted: true, Modified: []string{FIELD_DSCP, FIELD_SOURCE_ADDR}},
+		{TTL: 1, quoted: true, Modified: []string{}},
+		{TTL: 2, quoted: true, Modified: []string{FIELD_DSCP}},
+		{TTL: 2, quoted: true, Modified: []string{FIELD_DSCP}},
+		{TTL: 4},
+		{TTL: 5, quoted: true, Modified: []string{FIELD_DSCP, FIELD_SOURCE_ADDR}},
+	}
+	markQuoteChanges(hops)
+
+	assert.Equal([]string{}, hops[1].QuoteChanges)
+	assert.Equal([]string{FIELD_DSCP}, hops[2].QuoteChanges, "bleached between hop 1 and 2")
+	assert.Equal([]string{FIELD_SOURCE_ADDR}, hops[0].QuoteChanges, "NAT between hop 2 and 3")
+	assert.Nil(hops[4].QuoteChanges)
+	assert.Equal([]string{}, hops[5].QuoteChanges, "compared with the last hop that quoted anything")
+}
+
+func TestMarkQuoteChangesPerFlow(t *testing.T) {
+	assert := assert.New(t)
+	hops := []ProbeResponse{
+		{TTL: 1, FlowID: null.IntFrom(0), quoted: true, Modified: []string{}},
+		{TTL: 1, FlowID: null.IntFrom(1), quoted: true, Modified: []string{FIELD_ECN}},
+		{TTL: 2, FlowID: null.IntFrom(0), quoted: true, Modified: []string{FIELD_ECN}},
+		{TTL: 2, FlowID: null.IntFrom(1), quoted: true, Modified: []string{FIELD_ECN}},
+	}
+	markQuoteChanges(hops)
+
+	assert.Equal([]string{FIELD_ECN}, hops[1].QuoteChanges)
+	assert.Equal([]string{FIELD_ECN}, hops[2].QuoteChanges, "flow 0 only sees it at hop 2")
+	assert.Equal([]string{}, hops[3].QuoteChanges)
+}
+
+func TestBuildProbePacketDF(t *testing.T) {
+	assert := assert.New(t)
+	source, target := net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.7")
+	datagram := craftUDPDatagram(source, target, 40000, 33434, 4242)
+
+	// Plain tcp and udp probes leave fragmenting up to the kernel like anything else
+	sent, packet, buildErr := buildProbePacket(true, source, target, protocolUDP, 5, 0, false, datagram)
+	assert.Nil(buildErr)
+	assert.Equal(true, sent.IPHeader)
+	assert.Equal(false, sent.DF)
+	assert.Equal(false, quotedIPv4Flags(packet))
+	assert.Equal(5, sent.TTL)
+
+	sent, packet, _ = buildProbePacket(true, source, target, protocolUDP, 5, 0, true, datagram)
+	assert.Equal(true, sent.DF, "path MTU probes can't be fragmented")
+	assert.Equal(true, quotedIPv4Flags(packet))
+
+	sent, packet, _ = buildProbePacket(false, source, target, protocolTCP, 5, 0, false, datagram)
+	assert.Equal(false, sent.IPHeader)
+	assert.Equal(datagram, packet)
+}
+
+func TestQuotedTTLByType(t *testing.T) {
+	assert := assert.New(t)
+	exceeded := &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{}}
+	portUnreachable := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3, Body: &icmp.DstUnreach{}}
+	fragNeeded := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{}}
+	hop := func(ip string, ttl int, message *icmp.Message, quotedTTL int) ProbeResponse {
+		response := ProbeResponse{TTL: ttl, IP: null.StringFrom(ip), Responded: true}
+		response.setICMPDetails(SentPacket{TTL: ttl}, ICMPResponse{Response: message, OriginalHeader: &QuotedHeader{TTL: quotedTTL}})
+		return response
+	}
+
+	hops := []ProbeResponse{
+		hop("192.0.2.1", 1, exceeded, 1),
+		hop("192.0.2.9", 2, exceeded, 2),
+		// The destination is 3 hops out, probes with more TTL than that get there with some left
+		hop("198.51.100.7", 3, portUnreachable, 1),
+		hop("198.51.100.7", 6, portUnreachable, 4),
+		hop("198.51.100.7", 7, portUnreachable, 7),
+		// Path MTU probes are too big for the link behind the first hop, whatever their TTL
+		hop("192.0.2.1", 4, fragNeeded, 4),
+		hop("192.0.2.1", 5, fragNeeded, 6),
+	}
+	assert.Equal([]string{FIELD_TTL}, hops[1].Modified, "a hop before didn't decrement")
+	assert.Equal([]string{}, hops[3].Modified, "not known how far away yet")
+	assert.Equal([]string{FIELD_TTL}, hops[6].Modified, "can't have gone up")
+
+	markQuoteChanges(hops)
+	assert.Equal([]string{}, hops[0].Modified)
+	assert.Equal([]string{}, hops[2].Modified)
+	assert.Equal([]string{}, hops[3].Modified)
+	assert.Equal([]string{FIELD_TTL}, hops[4].Modified)
+	assert.Equal([]string{}, hops[5].Modified, "frag needed quoted as the probe arrived")
+	assert.Equal([]string{FIELD_TTL}, hops[6].Modified)
+}
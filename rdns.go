@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RDNS_DEFAULT_TTL          = time.Hour
+	RDNS_DEFAULT_NEGATIVE_TTL = 5 * time.Minute
+	RDNS_DEFAULT_TIMEOUT      = 2 * time.Second
+	RDNS_DEFAULT_CONCURRENCY  = 8
+	RDNS_MAX_ENTRIES          = 10000
+)
+
+// Every reverse lookup goes through this, main swaps in one built from the command line flags
+var rdnsCache = NewDNSCache(RDNS_DEFAULT_TTL, RDNS_DEFAULT_NEGATIVE_TTL, RDNS_DEFAULT_TIMEOUT, RDNS_DEFAULT_CONCURRENCY, "")
+
+// ReverseName is everything the PTR records of an address say about it. Confirmed is set when
+// one of the names resolves back to the address, which a spoofed or stale record won't.
+type ReverseName struct {
+	Names     []string
+	Confirmed bool
+}
+
+type dnsEntry struct {
+	name    ReverseName
+	expires time.Time
+}
+
+// dnsLookup is a lookup in progress, everyone asking for the same address while it runs
+// waits on done and shares the answer.
+type dnsLookup struct {
+	done chan struct{}
+	name ReverseName
+}
+
+// DNSCache remembers PTR lookups for hop addresses, the same routers show up in every probe.
+// Failed lookups are remembered too, for negativeTTL, so an address without a PTR record
+// isn't asked about again every interval. Lookups, forward confirmation included, are bounded
+// by concurrency and timeout.
+type DNSCache struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	resolver    *net.Resolver
+	slots       chan struct{}
+
+	lock     sync.Mutex
+	entries  map[string]dnsEntry
+	inFlight map[string]*dnsLookup
+
+	hits   uint64
+	misses uint64
+
+	// swapped out in tests
+	lookupAddr   func(ctx context.Context, addr string) ([]string, error)
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewDNSCache sets up a cache in front of the system resolver, or in front of resolverAddr
+// (host:port) if one is given.
+func NewDNSCache(positiveTTL, negativeTTL, timeout time.Duration, concurrency int, resolverAddr string) *DNSCache {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	resolver := net.DefaultResolver
+	if resolverAddr != "" {
+		dialer := net.Dialer{}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, resolverAddr)
+			},
+		}
+	}
+
+	return &DNSCache{
+		positiveTTL:  positiveTTL,
+		negativeTTL:  negativeTTL,
+		timeout:      timeout,
+		resolver:     resolver,
+		slots:        make(chan struct{}, concurrency),
+		entries:      make(map[string]dnsEntry),
+		inFlight:     make(map[string]*dnsLookup),
+		lookupAddr:   resolver.LookupAddr,
+		lookupIPAddr: resolver.LookupIPAddr,
+	}
+}
+
+// Lookup returns every PTR name for ip, from the cache when we can
+func (c *DNSCache) Lookup(ip string) ReverseName {
+	c.lock.Lock()
+	if entry, ok := c.entries[ip]; ok && time.Now().Before(entry.expires) {
+		c.lock.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return entry.name
+	}
+	if lookup, ok := c.inFlight[ip]; ok {
+		c.lock.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		<-lookup.done
+		return lookup.name
+	}
+
+	lookup := &dnsLookup{done: make(chan struct{})}
+	c.inFlight[ip] = lookup
+	c.lock.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	c.slots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	name, lookupErr := c.resolve(ctx, ip)
+	cancel()
+	<-c.slots
+
+	ttl := c.positiveTTL
+	if lookupErr != nil || len(name.Names) == 0 {
+		name, ttl = ReverseName{}, c.negativeTTL
+	}
+	lookup.name = name
+
+	c.lock.Lock()
+	if len(c.entries) >= RDNS_MAX_ENTRIES {
+		c.pruneLocked()
+	}
+	c.entries[ip] = dnsEntry{name: name, expires: time.Now().Add(ttl)}
+	delete(c.inFlight, ip)
+	c.lock.Unlock()
+	close(lookup.done)
+
+	return name
+}
+
+// resolve does the PTR lookup, then looks up every name it got until one points back at ip
+func (c *DNSCache) resolve(ctx context.Context, ip string) (ReverseName, error) {
+	names, lookupErr := c.lookupAddr(ctx, ip)
+	if lookupErr != nil {
+		return ReverseName{}, lookupErr
+	}
+
+	name := ReverseName{Names: names}
+	hopIP := net.ParseIP(ip)
+	for _, ptr := range names {
+		addrs, forwardErr := c.lookupIPAddr(ctx, ptr)
+		if forwardErr != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(hopIP) {
+				name.Confirmed = true
+				return name, nil
+			}
+		}
+	}
+	return name, nil
+}
+
+// pruneLocked drops expired entries, and everything if that wasn't enough to make room
+func (c *DNSCache) pruneLocked() {
+	now := time.Now()
+	for ip, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, ip)
+		}
+	}
+	if len(c.entries) >= RDNS_MAX_ENTRIES {
+		c.entries = make(map[string]dnsEntry)
+	}
+}
+
+func (c *DNSCache) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+func (c *DNSCache) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
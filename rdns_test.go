@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func noForwardLookups(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, fmt.Errorf("no such host")
+}
+
+func TestDNSCachePositiveAndNegative(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewDNSCache(time.Hour, time.Hour, time.Second, 2, "")
+	cache.lookupIPAddr = noForwardLookups
+	var queries int32
+	cache.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		if addr == "10.0.0.1" {
+			return []string{"gw.example.net."}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal([]string{"gw.example.net."}, cache.Lookup("10.0.0.1").Names)
+		assert.Nil(cache.Lookup("10.0.0.2").Names)
+	}
+
+	assert.Equal(int32(2), queries, "one query per address")
+	assert.Equal(uint64(2), cache.Misses())
+	assert.Equal(uint64(4), cache.Hits())
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewDNSCache(time.Hour, time.Millisecond, time.Second, 2, "")
+	cache.lookupIPAddr = noForwardLookups
+	var queries int32
+	cache.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		return nil, fmt.Errorf("no such host")
+	}
+
+	cache.Lookup("10.0.0.2")
+	time.Sleep(5 * time.Millisecond)
+	cache.Lookup("10.0.0.2")
+	assert.Equal(int32(2), queries, "negative entries expire on their own TTL")
+}
+
+func TestDNSCacheSharesLookupsInFlight(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewDNSCache(time.Hour, time.Hour, time.Second, 1, "")
+	cache.lookupIPAddr = noForwardLookups
+	release := make(chan struct{})
+	var queries int32
+	cache.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		return []string{"gw.example.net."}, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			defer wg.Done()
+			assert.Equal([]string{"gw.example.net."}, cache.Lookup("10.0.0.1").Names)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(int32(1), queries)
+}
+
+func TestDNSCacheTimeout(t *testing.T) {
+	cache := NewDNSCache(time.Hour, time.Hour, 10*time.Millisecond, 1, "")
+	cache.lookupIPAddr = noForwardLookups
+	cache.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	assert.Nil(t, cache.Lookup("10.0.0.1").Names)
+	assert.True(t, time.Since(start) < time.Second, "slow resolver doesn't hold up the probe")
+}
+
+func TestDNSCacheForwardConfirmation(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewDNSCache(time.Hour, time.Hour, time.Second, 2, "")
+	cache.lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		if addr == "10.0.0.1" {
+			return []string{"spoofed.example.net.", "gw.example.net."}, nil
+		}
+		return []string{"stale.example.net."}, nil
+	}
+	var forward int32
+	cache.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&forward, 1)
+		switch host {
+		case "gw.example.net.":
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("10.0.0.1")}}, nil
+		case "stale.example.net.":
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.9")}}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	confirmed := cache.Lookup("10.0.0.1")
+	assert.Equal([]string{"spoofed.example.net.", "gw.example.net."}, confirmed.Names)
+	assert.True(confirmed.Confirmed, "second name points back at the hop")
+
+	unconfirmed := cache.Lookup("10.0.0.2")
+	assert.Equal([]string{"stale.example.net."}, unconfirmed.Names)
+	assert.False(unconfirmed.Confirmed)
+
+	cache.Lookup("10.0.0.1")
+	assert.Equal(int32(3), forward, "forward lookups are cached with the names")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"strings"
+)
+
+// Why a hop answered with Destination Unreachable instead of passing the probe on. Port
+// unreachable isn't one of them, that's the destination answering a UDP probe.
+const (
+	UNREACHABLE_NETWORK       = "network"
+	UNREACHABLE_HOST          = "host"
+	UNREACHABLE_PROTOCOL      = "protocol"
+	UNREACHABLE_FRAGMENTATION = "fragmentation_needed"
+	UNREACHABLE_SOURCE_ROUTE  = "source_route"
+	UNREACHABLE_PROHIBITED    = "prohibited"
+	UNREACHABLE_PRECEDENCE    = "precedence"
+	UNREACHABLE_OTHER         = "other"
+)
+
+// Why a probe stopped going up in TTL. Unreachable ones are prefixed to the reason, IE:
+// unreachable_prohibited.
+const (
+	STOP_REACHED     = "reached"
+	STOP_MAX_HOPS    = "max_hops"
+	STOP_UNREACHABLE = "unreachable_"
+)
+
+var unreachableCodesV4 = map[int]string{
+	0:  UNREACHABLE_NETWORK,
+	1:  UNREACHABLE_HOST,
+	2:  UNREACHABLE_PROTOCOL,
+	4:  UNREACHABLE_FRAGMENTATION,
+	5:  UNREACHABLE_SOURCE_ROUTE,
+	6:  UNREACHABLE_NETWORK,
+	7:  UNREACHABLE_HOST,
+	8:  UNREACHABLE_HOST,
+	9:  UNREACHABLE_PROHIBITED,
+	10: UNREACHABLE_PROHIBITED,
+	11: UNREACHABLE_NETWORK,
+	12: UNREACHABLE_HOST,
+	13: UNREACHABLE_PROHIBITED,
+	14: UNREACHABLE_PRECEDENCE,
+	15: UNREACHABLE_PRECEDENCE,
+}
+
+var unreachableCodesV6 = map[int]string{
+	0: UNREACHABLE_NETWORK,
+	1: UNREACHABLE_PROHIBITED,
+	2: UNREACHABLE_NETWORK,
+	3: UNREACHABLE_HOST,
+	5: UNREACHABLE_PROHIBITED,
+	6: UNREACHABLE_PROHIBITED,
+}
+
+// The annotations classic traceroute prints next to a hop for each reason
+var unreachableMarkers = map[string]string{
+	UNREACHABLE_NETWORK:       "!N",
+	UNREACHABLE_HOST:          "!H",
+	UNREACHABLE_PROTOCOL:      "!P",
+	UNREACHABLE_FRAGMENTATION: "!F",
+	UNREACHABLE_SOURCE_ROUTE:  "!S",
+	UNREACHABLE_PROHIBITED:    "!X",
+	UNREACHABLE_PRECEDENCE:    "!V",
+	UNREACHABLE_OTHER:         "!",
+}
+
+// icmpTypeNumber is the type of an ICMP or ICMPv6 message as it was on the wire
+func icmpTypeNumber(icmpType icmp.Type) int {
+	switch value := icmpType.(type) {
+	case ipv4.ICMPType:
+		return int(value)
+	case ipv6.ICMPType:
+		return int(value)
+	}
+	return -1
+}
+
+// unreachableReason is why a Destination Unreachable was sent, empty for any other message
+// and for port unreachable.
+func unreachableReason(message *icmp.Message) string {
+	var reason string
+	var ok bool
+	switch message.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		if message.Code == 3 {
+			return ""
+		}
+		reason, ok = unreachableCodesV4[message.Code]
+	case ipv6.ICMPTypeDestinationUnreachable:
+		if message.Code == 4 {
+			return ""
+		}
+		reason, ok = unreachableCodesV6[message.Code]
+	default:
+		return ""
+	}
+
+	if !ok {
+		return UNREACHABLE_OTHER
+	}
+	return reason
+}
+
+// packetTooBig tells whether message is a hop saying our probe didn't fit its next hop,
+// Fragmentation Needed for IPv4 and Packet Too Big for IPv6.
+func packetTooBig(message *icmp.Message) bool {
+	switch message.Type {
+	case ipv4.ICMPTypeDestinationUnreachable:
+		return message.Code == 4
+	case ipv6.ICMPTypePacketTooBig:
+		return true
+	}
+	return false
+}
+
+// timeExceeded tells whether message is a hop saying our probe ran out of TTL on its way
+func timeExceeded(message *icmp.Message) bool {
+	return message.Type == ipv4.ICMPTypeTimeExceeded || message.Type == ipv6.ICMPTypeTimeExceeded
+}
+
+// returnHops guesses how many hops a reply took to get back to us. Hosts start replies at
+// 64, 128 or 255 depending on who made them, the smallest of those at or above what we got is
+// most likely it. Counted like TTLs, a reply from the first hop has come 1 hop.
+func returnHops(replyTTL int) int {
+	if replyTTL <= 0 {
+		return 0
+	}
+	for _, initial := range []int{64, 128, 255} {
+		if replyTTL <= initial {
+			return initial - replyTTL + 1
+		}
+	}
+	return 0
+}
+
+// tcpFlagNames spells out the flags of a TCP segment, IE: SYN,ACK
+func tcpFlagNames(flags byte) string {
+	names := []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+	set := make([]string, 0, len(names))
+	for bit, name := range names {
+		if flags&(1<<uint(bit)) != 0 {
+			set = append(set, name)
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+// stopReason is why the probe didn't go past the last TTL in hops. The first unreachable hop
+// wins over reaching the destination, a destination that answers with admin prohibited still
+// filtered us.
+func stopReason(hops []ProbeResponse) string {
+	unreachableTTL := 0
+	reason := ""
+	for _, hop := range hops {
+		if hop.Unreachable.Valid && (unreachableTTL == 0 || hop.TTL < unreachableTTL) {
+			unreachableTTL, reason = hop.TTL, hop.Unreachable.String
+		}
+	}
+	if unreachableTTL > 0 {
+		return STOP_UNREACHABLE + reason
+	}
+
+	if _, reached := destinationTTL(hops); reached {
+		return STOP_REACHED
+	}
+	return STOP_MAX_HOPS
+}
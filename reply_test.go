@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"testing"
+)
+
+func TestUnreachableReason(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(UNREACHABLE_PROHIBITED, unreachableReason(&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 13}))
+	assert.Equal(UNREACHABLE_HOST, unreachableReason(&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1}))
+	assert.Equal("", unreachableReason(&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3}), "port unreachable is the destination")
+	assert.Equal(UNREACHABLE_OTHER, unreachableReason(&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 42}))
+	assert.Equal(UNREACHABLE_PROHIBITED, unreachableReason(&icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 1}))
+	assert.Equal("", unreachableReason(&icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 4}))
+	assert.Equal("", unreachableReason(&icmp.Message{Type: ipv4.ICMPTypeTimeExceeded}))
+}
+
+func TestReturnHops(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(1, returnHops(64))
+	assert.Equal(5, returnHops(60))
+	assert.Equal(4, returnHops(125))
+	assert.Equal(3, returnHops(253))
+	assert.Equal(0, returnHops(0), "unknown TTL")
+}
+
+func TestTCPFlagNames(t *testing.T) {
+	assert.Equal(t, "SYN,ACK", tcpFlagNames(0x12))
+	assert.Equal(t, "RST,ACK", tcpFlagNames(0x14))
+}
+
+func TestTraceHopsStopsAtUnreachable(t *testing.T) {
+	assert := assert.New(t)
+	send := func(ttl int, attempt int) ProbeResponse {
+		response := ProbeResponse{TTL: ttl, Responded: true, IP: null.StringFrom("10.0.0.1"), HeaderDest: net.ParseIP("192.0.2.9")}
+		if ttl == 2 {
+			response.Unreachable = null.StringFrom(UNREACHABLE_PROHIBITED)
+		}
+		return response
+	}
+
+	hops := traceHops("192.0.2.9", 2, MAX_HOPS, send)
+	assert.Equal(4, len(hops), "nothing sent past the hop that filtered us")
+	assert.Equal(STOP_UNREACHABLE+UNREACHABLE_PROHIBITED, stopReason(hops))
+
+	assert.Equal(STOP_MAX_HOPS, stopReason(hops[:2]))
+	assert.Equal(STOP_REACHED, stopReason([]ProbeResponse{{TTL: 1, Responded: true, IP: null.StringFrom("192.0.2.9")}}))
+}
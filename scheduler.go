@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_GLOBAL_PPS      = 200
+	DEFAULT_DESTINATION_PPS = 20
+
+	// A destination nobody sent to for this long has a full bucket, which is no different from
+	// not having one at all.
+	SCHEDULER_BUCKET_IDLE = time.Minute
+)
+
+// Every probe and every packet we send goes through this, main swaps in one built from the
+// command line flags. Rates of 0 mean unlimited.
+var scheduler = NewScheduler(CONCURRENCY, 0, 0)
+
+// Scheduler keeps a large target list from bursting everything out at once. It caps how many
+// probes are out waiting on an answer at a time, and paces packets against a global packets per
+// second budget and a separate one per destination. Packets are never dropped, callers just
+// wait their turn. Runs towards a target queue behind the one going, but only one of them, any
+// more than that would be measuring the same thing twice.
+type Scheduler struct {
+	inFlight       chan struct{}
+	global         *tokenBucket
+	destinationPPS float64
+
+	lock         sync.Mutex
+	destinations map[string]*tokenBucket
+	lastSweep    time.Time
+	runs         map[string]chan struct{}
+	pending      map[string]bool
+}
+
+func NewScheduler(maxInFlight int, globalPPS float64, destinationPPS float64) *Scheduler {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &Scheduler{
+		inFlight:       make(chan struct{}, maxInFlight),
+		global:         newTokenBucket(globalPPS),
+		destinationPPS: destinationPPS,
+		destinations:   make(map[string]*tokenBucket),
+		lastSweep:      time.Now(),
+		runs:           make(map[string]chan struct{}),
+		pending:        make(map[string]bool),
+	}
+}
+
+// StartProbe blocks until there is room for another probe, call the returned func once it's
+// been answered or given up on.
+func (s *Scheduler) StartProbe() func() {
+	s.inFlight <- struct{}{}
+	return func() { <-s.inFlight }
+}
+
+// StartRun blocks until the last run towards target is done, call the returned func once this
+// one is. ok is false if another run is already waiting on it, in which case nothing was
+// started and the caller should skip this run, the waiting one will be along shortly.
+func (s *Scheduler) StartRun(target string) (done func(), ok bool) {
+	s.lock.Lock()
+	waiting := false
+	for {
+		finished, running := s.runs[target]
+		if !running {
+			break
+		}
+		if !waiting {
+			if s.pending[target] {
+				s.lock.Unlock()
+				return nil, false
+			}
+			s.pending[target], waiting = true, true
+		}
+		s.lock.Unlock()
+		<-finished
+		s.lock.Lock()
+	}
+	if waiting {
+		delete(s.pending, target)
+	}
+	finished := make(chan struct{})
+	s.runs[target] = finished
+	s.lock.Unlock()
+
+	return func() {
+		s.lock.Lock()
+		delete(s.runs, target)
+		s.lock.Unlock()
+		close(finished)
+	}, true
+}
+
+// InFlight is the number of probes currently waiting on an answer
+func (s *Scheduler) InFlight() int {
+	return len(s.inFlight)
+}
+
+// WaitPacket blocks until a packet towards destination fits in both the per destination and
+// global budgets.
+func (s *Scheduler) WaitPacket(destination string) {
+	s.lock.Lock()
+	if now := time.Now(); now.Sub(s.lastSweep) > SCHEDULER_BUCKET_IDLE {
+		for address, idle := range s.destinations {
+			if idle.idleSince(now) > SCHEDULER_BUCKET_IDLE {
+				delete(s.destinations, address)
+			}
+		}
+		s.lastSweep = now
+	}
+	bucket, ok := s.destinations[destination]
+	if !ok {
+		bucket = newTokenBucket(s.destinationPPS)
+		s.destinations[destination] = bucket
+	}
+	s.lock.Unlock()
+
+	bucket.Wait()
+	s.global.Wait()
+}
+
+// tokenBucket hands out rate tokens per second with a burst of one second's worth. Waiters
+// reserve their token up front, so they're served in the order they showed up even when the
+// bucket runs dry.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) Wait() {
+	if delay := b.reserve(time.Now()); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// idleSince is how long it's been since a token was last taken
+func (b *tokenBucket) idleSince(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return now.Sub(b.last)
+}
+
+// reserve takes a token, going into debt if there are none left, and returns how long the
+// caller has to wait for the debt to be paid off.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
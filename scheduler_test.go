@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketQueuesPastBurst(t *testing.T) {
+	assert := assert.New(t)
+	bucket := newTokenBucket(10)
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(time.Duration(0), bucket.reserve(now), "burst of one second's worth")
+	}
+	assert.Equal(100*time.Millisecond, bucket.reserve(now), "next waits a token interval")
+	assert.Equal(200*time.Millisecond, bucket.reserve(now), "waiters queue up behind each other")
+
+	// A second later the debt is paid off and there's room again
+	assert.Equal(time.Duration(0), bucket.reserve(now.Add(1300*time.Millisecond)))
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	bucket := newTokenBucket(0)
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, time.Duration(0), bucket.reserve(time.Now()))
+	}
+}
+
+func TestSchedulerLimitsInFlight(t *testing.T) {
+	assert := assert.New(t)
+	s := NewScheduler(2, 0, 0)
+
+	done1 := s.StartProbe()
+	s.StartProbe()
+	assert.Equal(2, s.InFlight())
+
+	started := make(chan struct{})
+	go func() {
+		s.StartProbe()
+		close(started)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("third probe started past the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done1()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("queued probe never started")
+	}
+}
+
+func TestSchedulerQueuesOneRunPerTarget(t *testing.T) {
+	assert := assert.New(t)
+	s := NewScheduler(1, 0, 0)
+
+	done, ok := s.StartRun("example.com")
+	assert.True(ok)
+	other, ok := s.StartRun("example.net")
+	assert.True(ok, "runs don't count against the probe limit")
+	other()
+
+	queued := make(chan func())
+	go func() {
+		queuedDone, _ := s.StartRun("example.com")
+		queued <- queuedDone
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok = s.StartRun("example.com")
+	assert.False(ok, "one already waiting")
+	select {
+	case <-queued:
+		t.Fatal("started before the previous run was done")
+	default:
+	}
+
+	done()
+	select {
+	case queuedDone := <-queued:
+		queuedDone()
+	case <-time.After(time.Second):
+		t.Fatal("queued run never started")
+	}
+	done, ok = s.StartRun("example.com")
+	assert.True(ok, "free again once the runs finished")
+	done()
+}
+
+func TestSchedulerForgetsIdleDestinations(t *testing.T) {
+	assert := assert.New(t)
+	s := NewScheduler(1, 0, 10)
+	s.WaitPacket("192.0.2.1")
+	s.destinations["192.0.2.1"].last = time.Now().Add(-2 * SCHEDULER_BUCKET_IDLE)
+	s.lastSweep = time.Now().Add(-2 * SCHEDULER_BUCKET_IDLE)
+
+	s.WaitPacket("192.0.2.2")
+	_, kept := s.destinations["192.0.2.1"]
+	assert.False(kept, "idle destination dropped")
+	assert.Equal(1, len(s.destinations))
+}
+
+func TestSchedulerPerDestinationRate(t *testing.T) {
+	s := NewScheduler(1, 0, 1)
+	start := time.Now()
+
+	// Different destinations don't hold each other up
+	s.WaitPacket("192.0.2.1")
+	s.WaitPacket("192.0.2.2")
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	SINK_VOYAGER = "voyager"
+	SINK_STDOUT  = "stdout"
+	SINK_FILE    = "file"
+	SINK_WEBHOOK = "webhook"
+
+	SINK_FILE_DEFAULT_MAX_MB      = 100
+	SINK_FILE_DEFAULT_MAX_BACKUPS = 5
+	SINK_WEBHOOK_DEFAULT_TEMPLATE = "{{json .}}"
+)
+
+// ResultSink is somewhere finished probes get sent. Emit must be safe to call concurrently and
+// deal with its own errors, nobody upstream is waiting on it.
+type ResultSink interface {
+	Emit(probe Probe)
+}
+
+// Every finished probe goes to all of these, set up by main from flags and the config file
+var resultSinks []ResultSink
+
+// emitResult fans a probe out to every sink. Sinks don't wait on each other, so a slow
+// webhook can't hold up the spool.
+func emitResult(probe Probe) {
+	for _, sink := range resultSinks {
+		go sink.Emit(probe)
+	}
+}
+
+// SinkConfig describes a single sink. Which fields matter depends on Type.
+type SinkConfig struct {
+	Type string `yaml:"type"`
+
+	// file
+	Path       string `yaml:"path"`
+	MaxSizeMB  int64  `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+
+	// webhook
+	URL      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Template string            `yaml:"template"`
+}
+
+// parseSinkFlag turns a -sink flag into a SinkConfig. Sinks with options take them after an
+// equals sign, ie file=/var/log/voyager.jsonl or webhook=https://example.com/hook.
+func parseSinkFlag(spec string) (SinkConfig, error) {
+	sinkType, value := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		sinkType, value = spec[:i], spec[i+1:]
+	}
+
+	config := SinkConfig{Type: sinkType}
+	switch sinkType {
+	case SINK_VOYAGER, SINK_STDOUT:
+	case SINK_FILE:
+		config.Path = value
+	case SINK_WEBHOOK:
+		config.URL = value
+	default:
+		return config, fmt.Errorf("unknown sink type: %s", sinkType)
+	}
+	return config, nil
+}
+
+// buildSinks sets up every configured sink. The voyager server sink needs the spool and batch
+// settings from main, so it's built by the func passed in.
+func buildSinks(configs []SinkConfig, newVoyagerSink func() (ResultSink, error)) ([]ResultSink, error) {
+	sinks := make([]ResultSink, 0, len(configs))
+	for _, config := range configs {
+		var sink ResultSink
+		var sinkErr error
+		switch config.Type {
+		case SINK_VOYAGER:
+			sink, sinkErr = newVoyagerSink()
+		case SINK_STDOUT:
+			sink = NewJSONLSink(os.Stdout)
+		case SINK_FILE:
+			if config.Path == "" {
+				return nil, fmt.Errorf("file sink needs a path")
+			}
+			maxSizeMB, maxBackups := config.MaxSizeMB, config.MaxBackups
+			if maxSizeMB == 0 {
+				maxSizeMB = SINK_FILE_DEFAULT_MAX_MB
+			}
+			if maxBackups == 0 {
+				maxBackups = SINK_FILE_DEFAULT_MAX_BACKUPS
+			}
+			sink, sinkErr = NewRotatingFileSink(config.Path, maxSizeMB*1024*1024, maxBackups)
+		case SINK_WEBHOOK:
+			sink, sinkErr = NewWebhookSink(config.URL, config.Headers, config.Template)
+		default:
+			sinkErr = fmt.Errorf("unknown sink type: %s", config.Type)
+		}
+		if sinkErr != nil {
+			return nil, sinkErr
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// JSONLSink writes every probe as a single line of JSON
+type JSONLSink struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+func NewJSONLSink(out io.Writer) *JSONLSink {
+	return &JSONLSink{out: out}
+}
+
+func (s *JSONLSink) Emit(probe Probe) {
+	payload, jsonErr := json.Marshal(probe)
+	if jsonErr != nil {
+		log.Warn("Error creating probe result payload: ", jsonErr)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, writeErr := s.out.Write(append(payload, '\n')); writeErr != nil {
+		log.Warn("Error writing probe result: ", writeErr)
+	}
+}
+
+// RotatingFileSink appends JSON lines to a file, moving it aside once it grows past maxBytes.
+// Old files are kept as path.1, path.2 and so on up to maxBackups, newest first.
+type RotatingFileSink struct {
+	lock       sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewRotatingFileSink(path string, maxBytes int64, maxBackups int) (*RotatingFileSink, error) {
+	sink := &RotatingFileSink{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if openErr := sink.open(); openErr != nil {
+		return nil, openErr
+	}
+	return sink, nil
+}
+
+func (s *RotatingFileSink) open() error {
+	file, openErr := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if openErr != nil {
+		return openErr
+	}
+	info, statErr := file.Stat()
+	if statErr != nil {
+		file.Close()
+		return statErr
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *RotatingFileSink) rotate() error {
+	s.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.maxBackups > 0 {
+		os.Rename(s.path, s.path+".1")
+	} else {
+		os.Remove(s.path)
+	}
+	return s.open()
+}
+
+func (s *RotatingFileSink) Emit(probe Probe) {
+	payload, jsonErr := json.Marshal(probe)
+	if jsonErr != nil {
+		log.Warn("Error creating probe result payload: ", jsonErr)
+		return
+	}
+	payload = append(payload, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size > 0 && s.size+int64(len(payload)) > s.maxBytes {
+		if rotateErr := s.rotate(); rotateErr != nil {
+			log.Warn("Unable to rotate results file: ", rotateErr)
+			return
+		}
+	}
+
+	n, writeErr := s.file.Write(payload)
+	s.size += int64(n)
+	if writeErr != nil {
+		log.Warn("Error writing probe result: ", writeErr)
+	}
+}
+
+// WebhookSink POSTs every probe to an arbitrary URL. The body comes from a text/template run
+// against the Probe, with a json func available, and defaults to the probe as plain JSON.
+type WebhookSink struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func NewWebhookSink(url string, headers map[string]string, body string) (*WebhookSink, error) {
+	if url == "" {
+		return nil, fmt.Errorf("webhook sink needs a url")
+	}
+	if body == "" {
+		body = SINK_WEBHOOK_DEFAULT_TEMPLATE
+	}
+
+	funcs := template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			payload, jsonErr := json.Marshal(value)
+			return string(payload), jsonErr
+		},
+	}
+	bodyTemplate, templateErr := template.New("webhook").Funcs(funcs).Parse(body)
+	if templateErr != nil {
+		return nil, templateErr
+	}
+
+	return &WebhookSink{url: url, headers: headers, template: bodyTemplate}, nil
+}
+
+func (s *WebhookSink) Emit(probe Probe) {
+	var body bytes.Buffer
+	if templateErr := s.template.Execute(&body, probe); templateErr != nil {
+		log.Warn("Error rendering webhook body: ", templateErr)
+		return
+	}
+
+	req, reqErr := http.NewRequest("POST", s.url, &body)
+	if reqErr != nil {
+		log.Warn("Error creating webhook request: ", reqErr)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, requestErr := httpClient.Do(req)
+	if requestErr != nil {
+		log.Warn("Webhook request failed: ", requestErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warn(fmt.Sprintf("Webhook rejected probe result: [HTTP%d] %s", resp.StatusCode, string(respBody)))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSinkFlag(t *testing.T) {
+	assert := assert.New(t)
+
+	config, parseErr := parseSinkFlag("file=/tmp/results.jsonl")
+	assert.Nil(parseErr)
+	assert.Equal(SinkConfig{Type: SINK_FILE, Path: "/tmp/results.jsonl"}, config)
+
+	config, parseErr = parseSinkFlag("webhook=https://example.com/hook?a=b")
+	assert.Nil(parseErr)
+	assert.Equal("https://example.com/hook?a=b", config.URL, "only split on the first equals")
+
+	_, parseErr = parseSinkFlag("kafka=broker:9092")
+	assert.Error(parseErr)
+}
+
+func TestRotatingFileSink(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "voyager-sink")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.jsonl")
+
+	// Small enough that every result after the first rotates the file
+	sink, sinkErr := NewRotatingFileSink(path, 10, 2)
+	assert.Nil(sinkErr)
+	for _, target := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		sink.Emit(Probe{Target: target})
+	}
+
+	current, _ := ioutil.ReadFile(path)
+	newest, _ := ioutil.ReadFile(path + ".1")
+	oldest, _ := ioutil.ReadFile(path + ".2")
+	assert.Contains(string(current), "192.0.2.4")
+	assert.Contains(string(newest), "192.0.2.3")
+	assert.Contains(string(oldest), "192.0.2.2")
+	_, statErr := os.Stat(path + ".3")
+	assert.True(os.IsNotExist(statErr), "backups capped")
+	assert.Equal(1, strings.Count(string(current), "\n"), "one JSON object per line")
+}
+
+func TestWebhookSinkTemplate(t *testing.T) {
+	assert := assert.New(t)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("secret", r.Header.Get("X-Token"))
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer server.Close()
+
+	sink, sinkErr := NewWebhookSink(server.URL, map[string]string{"X-Token": "secret"}, `{"dst": "{{.Target}}", "hops": {{json .Hops}}}`)
+	assert.Nil(sinkErr)
+	sink.Emit(Probe{Target: "192.0.2.1", Hops: []ProbeResponse{{TTL: 1}}})
+
+	body := <-bodies
+	assert.Contains(body, `"dst": "192.0.2.1"`)
+	assert.Contains(body, `"ttl":1`)
+}
+
+func TestBuildSinksValidates(t *testing.T) {
+	assert := assert.New(t)
+	noVoyager := func() (ResultSink, error) { return nil, nil }
+
+	_, buildErr := buildSinks([]SinkConfig{{Type: SINK_FILE}}, noVoyager)
+	assert.Error(buildErr, "file sink without path")
+
+	_, buildErr = buildSinks([]SinkConfig{{Type: SINK_WEBHOOK, URL: "http://x", Template: "{{"}}, noVoyager)
+	assert.Error(buildErr, "broken template")
+
+	sinks, buildErr := buildSinks([]SinkConfig{{Type: SINK_STDOUT}}, noVoyager)
+	assert.Nil(buildErr)
+	assert.Equal(1, len(sinks))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SPOOL_DEFAULT_DIR      = "/var/lib/voyager-probe/spool"
+	SPOOL_DEFAULT_MAX_MB   = 100
+	SPOOL_DEFAULT_MAX_AGE  = 24 * time.Hour
+	SPOOL_BACKOFF_BASE     = time.Second
+	SPOOL_BACKOFF_MAX      = 5 * time.Minute
+	SPOOL_FILE_EXTENSION   = ".json"
+	SPOOL_TEMP_EXTENSION   = ".tmp"
+	SPOOL_FILENAME_PADDING = 20
+)
+
+// Spool is a write ahead queue of probe results on local disk. Every result is written out
+// before any upload is attempted so nothing is lost while voyager server is unreachable, and a
+// single background uploader drains it oldest first. The spool is capped by total size and by
+// age, oldest results go first when either is exceeded. Results are uploaded in batches of up
+// to batchSize, waiting at most window for a batch to fill up.
+type Spool struct {
+	dir       string
+	maxBytes  int64
+	maxAge    time.Duration
+	batchSize int
+	window    time.Duration
+	upload    batchUploader
+
+	lock sync.Mutex
+	wake chan struct{}
+	seq  uint64
+
+	// spooled results oldest first and their total size, so writing one doesn't mean reading
+	// the whole directory back
+	index []spoolEntry
+	total int64
+}
+
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration, batchSize int, window time.Duration, upload batchUploader) (*Spool, error) {
+	if mkdirErr := os.MkdirAll(dir, 0700); mkdirErr != nil {
+		return nil, mkdirErr
+	}
+
+	// Half written results from a previous run are useless, the rename never happened
+	temps, _ := filepath.Glob(filepath.Join(dir, "*"+SPOOL_TEMP_EXTENSION))
+	for _, temp := range temps {
+		os.Remove(temp)
+	}
+
+	spool := &Spool{
+		dir:       dir,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		batchSize: batchSize,
+		window:    window,
+		upload:    upload,
+		wake:      make(chan struct{}, 1),
+	}
+	spool.rescan()
+	return spool, nil
+}
+
+// Emit writes the probe to disk and nudges the uploader. If the spool can't be written to the
+// upload is attempted directly so a full or broken disk doesn't stop results going out.
+func (s *Spool) Emit(probe Probe) {
+	if spoolErr := s.write(probe); spoolErr != nil {
+		log.Warn("Unable to spool probe result, uploading directly: ", spoolErr)
+		if _, uploadErr := s.upload([]Probe{probe}); uploadErr != nil {
+			log.Warn("Dropping probe result: ", uploadErr)
+		}
+		return
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write stores the probe under a name that sorts by creation time. Results are written to a
+// temp file first and renamed into place so the uploader never sees a partial one.
+func (s *Spool) write(probe Probe) error {
+	payload, jsonErr := json.Marshal(probe)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	name := fmt.Sprintf("%0*d-%0*d", SPOOL_FILENAME_PADDING, time.Now().UnixNano(), SPOOL_FILENAME_PADDING, atomic.AddUint64(&s.seq, 1))
+	temp := filepath.Join(s.dir, name+SPOOL_TEMP_EXTENSION)
+	if writeErr := ioutil.WriteFile(temp, payload, 0600); writeErr != nil {
+		os.Remove(temp)
+		return writeErr
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := filepath.Join(s.dir, name+SPOOL_FILE_EXTENSION)
+	if renameErr := os.Rename(temp, path); renameErr != nil {
+		os.Remove(temp)
+		return renameErr
+	}
+	s.index = append(s.index, spoolEntry{path: path, size: int64(len(payload)), created: time.Now()})
+	s.total += int64(len(payload))
+	s.enforceLimits()
+	return nil
+}
+
+type spoolEntry struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+// entries lists spooled results, oldest first
+func (s *Spool) entries() []spoolEntry {
+	batch, _ := s.oldest(-1)
+	return batch
+}
+
+// oldest lists up to n of the oldest spooled results, all of them if n is negative, along with
+// how many there are in total
+func (s *Spool) oldest(n int) ([]spoolEntry, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n < 0 || n > len(s.index) {
+		n = len(s.index)
+	}
+	return append([]spoolEntry{}, s.index[:n]...), len(s.index)
+}
+
+// rescan builds the index from what's actually in the spool directory, which only has to
+// happen once when the spool is opened.
+func (s *Spool) rescan() {
+	files, readErr := ioutil.ReadDir(s.dir)
+	if readErr != nil {
+		log.Warn("Unable to read spool directory: ", readErr)
+		return
+	}
+
+	s.index, s.total = make([]spoolEntry, 0, len(files)), 0
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), SPOOL_FILE_EXTENSION) {
+			continue
+		}
+		s.index = append(s.index, spoolEntry{
+			path:    filepath.Join(s.dir, file.Name()),
+			size:    file.Size(),
+			created: file.ModTime(),
+		})
+		s.total += file.Size()
+	}
+	sort.Slice(s.index, func(i, j int) bool { return s.index[i].path < s.index[j].path })
+}
+
+// forget drops results that are no longer on disk from the index. Caller must hold the lock.
+func (s *Spool) forget(paths map[string]bool) {
+	kept := s.index[:0]
+	for _, entry := range s.index {
+		if paths[entry.path] {
+			s.total -= entry.size
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	s.index = kept
+}
+
+// enforceLimits drops results that are too old, then the oldest ones until the spool fits in
+// maxBytes. Only the oldest result and the running total need looking at. Caller must hold
+// the lock.
+func (s *Spool) enforceLimits() {
+	expired := func() bool {
+		return len(s.index) > 0 && s.maxAge > 0 && time.Since(s.index[0].created) > s.maxAge
+	}
+	oversize := func() bool {
+		return s.maxBytes > 0 && s.total > s.maxBytes
+	}
+
+	dropped := 0
+	for len(s.index) > 0 && (expired() || oversize()) {
+		entry := s.index[0]
+		if removeErr := os.Remove(entry.path); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Warn("Unable to remove spooled result: ", removeErr)
+			break
+		}
+		s.index = s.index[1:]
+		s.total -= entry.size
+		dropped++
+	}
+
+	if dropped > 0 {
+		log.Warn(fmt.Sprintf("Spool limits exceeded, dropped %d oldest results", dropped))
+	}
+}
+
+// Run drains the spool forever. A failed upload backs off exponentially with jitter and then
+// retries from the same result, so results always reach the server in the order they were taken.
+func (s *Spool) Run() {
+	failures := 0
+	for {
+		batch, pending := s.oldest(s.batchSize)
+		if pending == 0 {
+			<-s.wake
+			continue
+		}
+
+		// Give a partial batch until the oldest result in it is window old to fill up
+		if wait := s.window - time.Since(batch[0].created); pending < s.batchSize && wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-s.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		uploadErr := s.send(batch)
+		if uploadErr == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		delay := spoolBackoff(failures)
+		log.Warn(fmt.Sprintf("Upload of spooled results failed, %d pending, retrying in %s: %s", pending, delay, uploadErr))
+
+		// New results arriving shouldn't cut the backoff short, but age limits still apply
+		time.Sleep(delay)
+		s.lock.Lock()
+		s.enforceLimits()
+		s.lock.Unlock()
+	}
+}
+
+// send uploads a batch of spooled results and removes whatever the server is done with.
+// Results that can't be read back are dropped rather than retried.
+func (s *Spool) send(batch []spoolEntry) error {
+	probes := make([]Probe, 0, len(batch))
+	paths := make([]string, 0, len(batch))
+	gone := make(map[string]bool)
+	for _, entry := range batch {
+		payload, readErr := ioutil.ReadFile(entry.path)
+		if os.IsNotExist(readErr) {
+			// aged out or dropped for space while we weren't looking
+			gone[entry.path] = true
+			continue
+		} else if readErr != nil {
+			return readErr
+		}
+
+		var probe Probe
+		if jsonErr := json.Unmarshal(payload, &probe); jsonErr != nil {
+			log.Warn(fmt.Sprintf("Dropping unreadable spooled result %s: %s", entry.path, jsonErr))
+			os.Remove(entry.path)
+			gone[entry.path] = true
+			continue
+		}
+		probes = append(probes, probe)
+		paths = append(paths, entry.path)
+	}
+
+	done, uploadErr := 0, error(nil)
+	if len(probes) > 0 {
+		done, uploadErr = s.upload(probes)
+	}
+
+	s.lock.Lock()
+	for _, path := range paths[:done] {
+		os.Remove(path)
+		gone[path] = true
+	}
+	s.forget(gone)
+	s.lock.Unlock()
+	return uploadErr
+}
+
+// spoolBackoff doubles the delay for every consecutive failure up to SPOOL_BACKOFF_MAX, then
+// picks somewhere in the top half of it so a fleet of probes doesn't retry in lockstep.
+func spoolBackoff(failures int) time.Duration {
+	delay := SPOOL_BACKOFF_MAX
+	if failures < 32 {
+		if scaled := SPOOL_BACKOFF_BASE << uint(failures-1); scaled > 0 && scaled < SPOOL_BACKOFF_MAX {
+			delay = scaled
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, maxBytes int64, upload batchUploader) *Spool {
+	dir, dirErr := ioutil.TempDir("", "voyager-spool")
+	if dirErr != nil {
+		t.Fatal(dirErr)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	spool, spoolErr := NewSpool(dir, maxBytes, time.Hour, 2, 0, upload)
+	if spoolErr != nil {
+		t.Fatal(spoolErr)
+	}
+	return spool
+}
+
+func TestSpoolDrainsOldestFirst(t *testing.T) {
+	assert := assert.New(t)
+	var lock sync.Mutex
+	uploaded := make([]string, 0)
+	done := make(chan struct{})
+	spool := newTestSpool(t, 0, func(probes []Probe) (int, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		assert.True(len(probes) <= 2, "batch size honored")
+		for _, probe := range probes {
+			uploaded = append(uploaded, probe.Target)
+		}
+		if len(uploaded) == 3 {
+			close(done)
+		}
+		return len(probes), nil
+	})
+
+	// Written while "offline", nothing drains until the uploader starts
+	for i := 0; i < 3; i++ {
+		spool.Emit(Probe{Target: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	assert.Equal(3, len(spool.entries()), "results persisted before upload")
+
+	go spool.Run()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("spool never drained")
+	}
+
+	lock.Lock()
+	assert.Equal([]string{"192.0.2.0", "192.0.2.1", "192.0.2.2"}, uploaded)
+	lock.Unlock()
+
+	// The last file is removed just after its upload returns
+	deadline := time.Now().Add(time.Second)
+	for len(spool.entries()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(0, len(spool.entries()), "uploaded results removed")
+}
+
+func TestSpoolKeepsUnsentResults(t *testing.T) {
+	assert := assert.New(t)
+	var done int
+	var uploadErr error
+	spool := newTestSpool(t, 0, func(probes []Probe) (int, error) { return done, uploadErr })
+	spool.Emit(Probe{Target: "192.0.2.1"})
+	spool.Emit(Probe{Target: "192.0.2.2"})
+
+	done, uploadErr = 0, fmt.Errorf("connection refused")
+	assert.Error(spool.send(spool.entries()))
+	assert.Equal(2, len(spool.entries()), "kept for retry")
+
+	done = 1
+	assert.Error(spool.send(spool.entries()))
+	entries := spool.entries()
+	assert.Equal(1, len(entries), "only the uploaded result removed")
+	contents, _ := ioutil.ReadFile(entries[0].path)
+	assert.Contains(string(contents), "192.0.2.2")
+}
+
+func TestSpoolSizeCapDropsOldest(t *testing.T) {
+	assert := assert.New(t)
+	spool := newTestSpool(t, 0, func(probes []Probe) (int, error) { return len(probes), nil })
+	spool.Emit(Probe{Target: "192.0.2.1"})
+	spool.maxBytes = spool.entries()[0].size * 2
+
+	spool.Emit(Probe{Target: "192.0.2.2"})
+	spool.Emit(Probe{Target: "192.0.2.3"})
+
+	entries := spool.entries()
+	assert.Equal(2, len(entries))
+	contents, _ := ioutil.ReadFile(entries[0].path)
+	assert.Contains(string(contents), "192.0.2.2", "oldest result dropped first")
+}
+
+func TestSpoolIndexesOnStartup(t *testing.T) {
+	assert := assert.New(t)
+	upload := func(probes []Probe) (int, error) { return len(probes), nil }
+	spool := newTestSpool(t, 0, upload)
+	spool.Emit(Probe{Target: "192.0.2.1"})
+	spool.Emit(Probe{Target: "192.0.2.2"})
+
+	// Results left behind by a previous run are picked up, sizes and all
+	reopened, openErr := NewSpool(spool.dir, 0, time.Hour, 2, 0, upload)
+	assert.Nil(openErr)
+	entries := reopened.entries()
+	assert.Equal(2, len(entries))
+	for i, entry := range spool.entries() {
+		assert.Equal(entry.path, entries[i].path)
+		assert.Equal(entry.size, entries[i].size)
+	}
+	assert.Equal(spool.total, reopened.total)
+
+	assert.Nil(reopened.send(reopened.entries()[:1]))
+	assert.Equal(1, len(reopened.entries()))
+	assert.Equal(spool.entries()[1].size, reopened.total, "running total follows uploads")
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	assert := assert.New(t)
+	for failures := 1; failures < 40; failures++ {
+		delay := spoolBackoff(failures)
+		assert.True(delay > 0 && delay <= SPOOL_BACKOFF_MAX, "backoff bounded")
+	}
+	assert.True(spoolBackoff(1) <= SPOOL_BACKOFF_BASE)
+	assert.True(spoolBackoff(40) >= SPOOL_BACKOFF_MAX/2)
+}
+
+func TestUploadErrorClassification(t *testing.T) {
+	assert := assert.New(t)
+	for _, status := range []int{500, 503, 429, 401} {
+		_, rejected := uploadError(status, nil).(*RejectedError)
+		assert.False(rejected, fmt.Sprintf("HTTP%d retried", status))
+	}
+	_, rejected := uploadError(400, nil).(*RejectedError)
+	assert.True(rejected, "HTTP400 dropped")
+}
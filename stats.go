@@ -0,0 +1,133 @@
+package main
+
+import (
+	"gopkg.in/guregu/null.v4"
+	"math"
+	"sort"
+)
+
+// HopSummary boils every response we got at one TTL down to the numbers consumers actually
+// look at. RTTs are in milliseconds like response_time, and null when nothing answered.
+type HopSummary struct {
+	TTL       int         `json:"ttl"`
+	Address   null.String `json:"address"`
+	Addresses []string    `json:"addresses"`
+	Sent      int         `json:"sent"`
+	Received  int         `json:"received"`
+	Loss      float64     `json:"loss_percent"`
+	RTTLast   null.Float  `json:"rtt_last"`
+	RTTMin    null.Float  `json:"rtt_min"`
+	RTTAvg    null.Float  `json:"rtt_avg"`
+	RTTMax    null.Float  `json:"rtt_max"`
+	RTTStdDev null.Float  `json:"rtt_stddev"`
+	Jitter    null.Float  `json:"jitter"`
+
+	// response times per address, only needed while the agent holds on to the probe
+	rtts map[string][]float64
+}
+
+// summarizeHops groups responses by TTL. Responses are taken in the order their probes were
+// sent, not the order they came back in, so jitter and the last RTT mean what they say.
+// Addresses keep the order they first answered in and the best guess for the hop is whichever
+// answered most, the first one winning a tie.
+func summarizeHops(hops []ProbeResponse) []HopSummary {
+	sent := make([]ProbeResponse, len(hops))
+	copy(sent, hops)
+	sort.SliceStable(sent, func(i, j int) bool { return sent[i].sentAt.Before(sent[j].sentAt) })
+	hops = sent
+
+	byTTL := make(map[int]*HopSummary)
+	samples := make(map[int][]float64)
+	ttls := make([]int, 0)
+	for _, hop := range hops {
+		summary, ok := byTTL[hop.TTL]
+		if !ok {
+			summary = &HopSummary{TTL: hop.TTL, Addresses: make([]string, 0), rtts: make(map[string][]float64)}
+			byTTL[hop.TTL] = summary
+			ttls = append(ttls, hop.TTL)
+		}
+		summary.Sent++
+		if !hop.Responded {
+			continue
+		}
+
+		summary.Received++
+		ip := hop.IP.ValueOrZero()
+		if _, seen := summary.rtts[ip]; !seen {
+			summary.Addresses = append(summary.Addresses, ip)
+		}
+		rtt := hopRTT(hop)
+		summary.rtts[ip] = append(summary.rtts[ip], rtt)
+		samples[hop.TTL] = append(samples[hop.TTL], rtt)
+	}
+
+	sort.Ints(ttls)
+	summaries := make([]HopSummary, 0, len(ttls))
+	for _, ttl := range ttls {
+		summary := byTTL[ttl]
+		summary.Loss = 100 * float64(summary.Sent-summary.Received) / float64(summary.Sent)
+
+		best := 0
+		for _, ip := range summary.Addresses {
+			if len(summary.rtts[ip]) > best {
+				best = len(summary.rtts[ip])
+				summary.Address = null.StringFrom(ip)
+			}
+		}
+
+		if rtts := samples[ttl]; len(rtts) > 0 {
+			stats := rttStats(rtts)
+			summary.RTTLast = null.FloatFrom(rtts[len(rtts)-1])
+			summary.RTTMin = null.FloatFrom(stats.min)
+			summary.RTTAvg = null.FloatFrom(stats.avg)
+			summary.RTTMax = null.FloatFrom(stats.max)
+			summary.RTTStdDev = null.FloatFrom(stats.stddev)
+			summary.Jitter = null.FloatFrom(stats.jitter)
+		}
+		summaries = append(summaries, *summary)
+	}
+	return summaries
+}
+
+type rttSummary struct {
+	min    float64
+	avg    float64
+	max    float64
+	stddev float64
+	jitter float64
+}
+
+// rttStats works out the spread of a set of response times. Stddev is the population one and
+// jitter the plain mean of the absolute differences between consecutive samples. That's not
+// the smoothed estimate RFC 3550 has RTP tools report, so don't expect the same numbers.
+func rttStats(rtts []float64) rttSummary {
+	stats := rttSummary{min: rtts[0], max: rtts[0]}
+	var total float64
+	for i, rtt := range rtts {
+		stats.min = math.Min(stats.min, rtt)
+		stats.max = math.Max(stats.max, rtt)
+		total += rtt
+		if i > 0 {
+			stats.jitter += math.Abs(rtt - rtts[i-1])
+		}
+	}
+	stats.avg = total / float64(len(rtts))
+	if len(rtts) > 1 {
+		stats.jitter /= float64(len(rtts) - 1)
+	}
+
+	var variance float64
+	for _, rtt := range rtts {
+		variance += (rtt - stats.avg) * (rtt - stats.avg)
+	}
+	stats.stddev = math.Sqrt(variance / float64(len(rtts)))
+	return stats
+}
+
+// hopRTT is the response time in milliseconds, with microsecond precision when we have it
+func hopRTT(hop ProbeResponse) float64 {
+	if hop.TimeMicros != 0 {
+		return float64(hop.TimeMicros) / 1000
+	}
+	return float64(hop.Time)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"testing"
+	"time"
+)
+
+func TestSummarizeHops(t *testing.T) {
+	assert := assert.New(t)
+	hops := []ProbeResponse{
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.2.1"), Time: 4},
+		{TTL: 1, Responded: true, IP: null.StringFrom("10.0.1.1"), Time: 2},
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.2.2"), Time: 8},
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.2.2"), Time: 6},
+		{TTL: 1},
+		{TTL: 3},
+	}
+
+	summaries := summarizeHops(hops)
+	assert.Equal(3, len(summaries))
+
+	first := summaries[0]
+	assert.Equal(1, first.TTL, "sorted by TTL")
+	assert.Equal(2, first.Sent)
+	assert.Equal(1, first.Received)
+	assert.Equal(50.0, first.Loss)
+	assert.Equal(null.FloatFrom(0), first.Jitter, "single sample has no jitter")
+
+	second := summaries[1]
+	assert.Equal([]string{"10.0.2.1", "10.0.2.2"}, second.Addresses, "first answered first")
+	assert.Equal(null.StringFrom("10.0.2.2"), second.Address, "most responses wins")
+	assert.Equal(null.FloatFrom(6), second.RTTLast, "latest answer in the order sent")
+	assert.Equal(null.FloatFrom(4), second.RTTMin)
+	assert.Equal(null.FloatFrom(6), second.RTTAvg)
+	assert.Equal(null.FloatFrom(8), second.RTTMax)
+	assert.InDelta(1.633, second.RTTStdDev.Float64, 0.001)
+	assert.Equal(null.FloatFrom(3), second.Jitter, "mean of |8-4| and |6-8|")
+
+	silent := summaries[2]
+	assert.Equal(100.0, silent.Loss)
+	assert.False(silent.Address.Valid)
+	assert.False(silent.RTTAvg.Valid, "no RTT when nothing answered")
+	assert.Equal(0, len(silent.Addresses))
+}
+
+func TestSummarizeHopsInSendOrder(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	sample := func(rtt int64, sent int) ProbeResponse {
+		return ProbeResponse{TTL: 1, Responded: true, IP: null.StringFrom("10.0.1.1"), Time: rtt, sentAt: start.Add(time.Duration(sent) * time.Millisecond)}
+	}
+	// The slow first probe's goroutine finishes last
+	hops := []ProbeResponse{sample(2, 1), sample(4, 2), sample(10, 0)}
+
+	summary := summarizeHops(hops)[0]
+	assert.Equal(null.FloatFrom(4), summary.RTTLast, "last one sent, not the last one back")
+	assert.Equal(null.FloatFrom(5), summary.Jitter, "mean of |2-10| and |4-2|")
+	assert.Equal(int64(2), hops[0].Time, "hops left as they were")
+}
+
+func TestHopRTTPrefersMicroseconds(t *testing.T) {
+	assert := assert.New(t)
+	var response ProbeResponse
+	setRTT(&response, 850*time.Microsecond)
+
+	assert.Equal(int64(0), response.Time, "milliseconds kept as they were")
+	assert.Equal(int64(850), response.TimeMicros)
+	assert.Equal(0.85, hopRTT(response))
+	assert.Equal(3.0, hopRTT(ProbeResponse{Time: 3}), "results without microseconds still work")
+}
@@ -5,12 +5,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/ipv4"
 	"gopkg.in/guregu/null.v4"
 	"net"
-	"strconv"
-	"strings"
-	"sync"
 	"time"
 )
 
@@ -91,56 +87,18 @@ func calcTCPChecksum(data []byte, srcip, dstip [4]byte) uint16 {
 
 	}
 
-	sumThis := make([]byte, 0, len(pseudoHeader)+len(data))
-	sumThis = append(sumThis, pseudoHeader...)
-	sumThis = append(sumThis, data...)
-
-	lenSumThis := len(sumThis)
-	var nextWord uint16
-	var sum uint32
-	for i := 0; i+1 < lenSumThis; i += 2 {
-		nextWord = uint16(sumThis[i])<<8 | uint16(sumThis[i+1])
-		sum += uint32(nextWord)
-
-	}
-	if lenSumThis%2 != 0 {
-		//fmt.Println("Odd byte")
-		sum += uint32(sumThis[len(sumThis)-1])
-
-	}
-
-	// Add back any carry, and any carry from adding the carry
-	sum = (sum >> 16) + (sum & 0xffff)
-	sum = sum + (sum >> 16)
-
-	// Bitwise complement
-	return uint16(^sum)
-
+	return onesComplementChecksum(pseudoHeader, data)
 }
 
-func craftTCPSYNHeader(src, dst net.IP, srcPort, dstPort uint16) []byte {
-	srcOctets := strings.Split(src.String(), ".")
-	dstOctets := strings.Split(dst.String(), ".")
-
-	// Need to convert IP type into byte array containing each octet
-	// We dont need to bother with error checking since a valid net.IP struct will always
-	// be able to be converted to int
-	srcFirst, _ := strconv.Atoi(srcOctets[0])
-	srcSecond, _ := strconv.Atoi(srcOctets[1])
-	srcThird, _ := strconv.Atoi(srcOctets[2])
-	srcFourth, _ := strconv.Atoi(srcOctets[3])
-	srcBytes := [4]byte{byte(srcFirst), byte(srcSecond), byte(srcThird), byte(srcFourth)}
-
-	dstFirst, _ := strconv.Atoi(dstOctets[0])
-	dstSecond, _ := strconv.Atoi(dstOctets[1])
-	dstThird, _ := strconv.Atoi(dstOctets[2])
-	dstFourth, _ := strconv.Atoi(dstOctets[3])
-	dstBytes := [4]byte{byte(dstFirst), byte(dstSecond), byte(dstThird), byte(dstFourth)}
+func calcTCPChecksum6(data []byte, srcip, dstip [16]byte) uint16 {
+	return onesComplementChecksum(pseudoHeader(srcip[:], dstip[:], protocolTCP, len(data)), data)
+}
 
+func craftTCPSYNHeader(src, dst net.IP, srcPort, dstPort uint16, seq uint32) []byte {
 	header := TCPHeader{
 		Source:      srcPort,
 		Destination: dstPort,
-		SeqNum:      0,
+		SeqNum:      seq, // probe identifier, quoted back to us by transit hops
 		AckNum:      0,
 		DataOffset:  5,   // 4 bits
 		Reserved:    0,   // 3 bits
@@ -154,11 +112,21 @@ func craftTCPSYNHeader(src, dst net.IP, srcPort, dstPort uint16) []byte {
 
 	payload := header.Marshal()
 
-	// Instead of doing 2 passes through Marshal, update byte array in palce
-	checkSum := calcTCPChecksum(payload, srcBytes, dstBytes)
-	checksumBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(checksumBytes, checkSum) // Why is this little endian?
-	payload[17], payload[18] = checksumBytes[0], checksumBytes[1]
+	// Instead of doing 2 passes through Marshal, update byte array in place. Checksum
+	// covers a pseudo header that differs between address families.
+	var checkSum uint16
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		var srcBytes, dstBytes [4]byte
+		copy(srcBytes[:], src4)
+		copy(dstBytes[:], dst4)
+		checkSum = calcTCPChecksum(payload, srcBytes, dstBytes)
+	} else {
+		var srcBytes, dstBytes [16]byte
+		copy(srcBytes[:], src.To16())
+		copy(dstBytes[:], dst.To16())
+		checkSum = calcTCPChecksum6(payload, srcBytes, dstBytes)
+	}
+	binary.BigEndian.PutUint16(payload[16:18], checkSum)
 
 	return payload
 }
@@ -168,105 +136,194 @@ type TCPProbeExecutor struct {
 }
 
 func (u *TCPProbeExecutor) Execute(target string, port uint16, count int) ([]ProbeResponse, error) {
-	// LookupAddr will return IPs even if IPs are passed in. For domain name targets, we'll only return
-	// the first result, at least for now
-	addrResult, addrErr := net.LookupHost(target)
+	// For domain name targets, we'll only probe the first result of the requested address
+	// family, at least for now
+	targetIP, addrErr := resolveTarget(target, u.AddressFamily)
 	if addrErr != nil {
 		return nil, addrErr
 	}
-	log.Debug(fmt.Sprintf("Look result: %s -> %s", target, addrResult[0]))
-	target = addrResult[0]
+	log.Debug(fmt.Sprintf("Look result: %s -> %s", target, targetIP))
+	target = targetIP.String()
 
 	log.Info("Starting TCP probes to ", target)
 
-	currentTTL := 1
-	hops := make([]ProbeResponse, 0)
-	for currentTTL <= MAX_HOPS {
-		var probewg sync.WaitGroup
-		batch := ProbeBatch{hops: make([]ProbeResponse, 0, count)}
-		probewg.Add(count)
-
-		for i := 0; i < count; i++ {
-			go sendTCPProbe(&probewg, &batch, target, port, currentTTL)
+	// In paris mode every probe of the run leaves from the same source port so the 5-tuple,
+	// and with it the flow hash ECMP load balancers use, never changes. Probes are told apart
+	// by sequence number alone.
+	var sender hopSender
+	if u.Paris {
+		send, closeFlows, flowErr := u.OpenFlows(targetIP, port)
+		if flowErr != nil {
+			return nil, flowErr
 		}
-		probewg.Wait()
+		defer closeFlows()
 
-		hops = append(hops, batch.hops...)
-		currentTTL++
-		if batch.IsFinal(target) {
-			break
+		sender = func(ttl int, attempt int) ProbeResponse {
+			return send(ttl, 0)
+		}
+	} else {
+		sender = func(ttl int, attempt int) ProbeResponse {
+			listener, listenerErr := reserveTCPPort(targetIP)
+			if listenerErr != nil {
+				log.Warn("Error setting up TCP listener: ", listenerErr)
+				return ProbeResponse{TTL: ttl}
+			}
+			defer listener.Close()
+
+			return sendTCPProbe(targetIP, uint16(listener.Addr().(*net.TCPAddr).Port), port, ttl, u.tos())
 		}
 	}
 
+	hops := traceHops(target, count, u.maxHops(), sender)
+
 	// TODO: error handling
 	log.Debug("probe complete: ", target)
 	return hops, nil
 }
 
-func sendTCPProbe(wg *sync.WaitGroup, batch *ProbeBatch, target string, port uint16, ttl int) {
-	// Setup a listener so OS binds a source port for us to use
-	ipAddr, addrErr := net.ResolveTCPAddr("tcp4", "0.0.0.0:0")
-	if addrErr != nil {
-		log.Warn("IPAddr err: ", addrErr)
-		return
+// OpenFlows implements FlowProber. Flow 0 leaves from a reserved source port and every other
+// flow from the ports counting up from it. Only the first one is actually bound, the kernel
+// resets any SYN-ACK sent to the others which is fine for a SYN probe.
+func (u *TCPProbeExecutor) OpenFlows(targetIP net.IP, port uint16) (flowSender, func(), error) {
+	listener, listenerErr := reserveTCPPort(targetIP)
+	if listenerErr != nil {
+		return nil, nil, listenerErr
 	}
 
-	rawListener, listenerErr := net.ListenTCP("tcp4", ipAddr)
-	if listenerErr != nil {
-		log.Warn("Error setting up TCP listener: ", listenerErr)
-		return
+	basePort := listener.Addr().(*net.TCPAddr).Port
+	send := func(ttl int, flow int) ProbeResponse {
+		// Wrap around within the non privileged range rather than overflowing
+		sourcePort := 1024 + (basePort-1024+flow)%(65536-1024)
+		response := sendTCPProbe(targetIP, uint16(sourcePort), port, ttl, u.tos())
+		response.FlowID = null.IntFrom(int64(flow))
+		return response
 	}
-	defer rawListener.Close()
+	return send, func() { listener.Close() }, nil
+}
+
+// reserveTCPPort sets up a listener so the OS binds a source port for us to use. The port
+// stays ours for as long as the listener is open.
+func reserveTCPPort(targetIP net.IP) (*net.TCPListener, error) {
+	listenNetwork, listenAddr := "tcp4", "0.0.0.0:0"
+	if targetIP.To4() == nil {
+		listenNetwork, listenAddr = "tcp6", "[::]:0"
+	}
+	ipAddr, addrErr := net.ResolveTCPAddr(listenNetwork, listenAddr)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+
+	return net.ListenTCP(listenNetwork, ipAddr)
+}
+
+func sendTCPProbe(targetIP net.IP, sourcePort uint16, port uint16, ttl int, tos int) ProbeResponse {
+	release := scheduler.StartProbe()
+	defer release()
+
+	probeResponse := ProbeResponse{TTL: ttl}
+	target := targetIP.String()
 
 	// Use the port we got from bind in new socket towards target
-	rawConn, rawErr := net.Dial("ip4:tcp", target)
+	rawConn, rawErr := net.Dial(rawNetwork(targetIP, "tcp"), target)
 	if rawErr != nil {
 		log.Warn("Error creating socket towards target: ", rawErr)
-		return
+		return probeResponse
 	}
 	defer rawConn.Close()
-	ip4Conn := ipv4.NewConn(rawConn)
-	ip4Conn.SetTTL(ttl)
-
-	sourcePortString := strings.Split(rawListener.Addr().String(), ":")[1]
-	sourcePortInt, _ := strconv.Atoi(sourcePortString)
-	srcIP := net.ParseIP(rawConn.LocalAddr().String())
-	dstIP := net.ParseIP(target)
-	payload := craftTCPSYNHeader(srcIP, dstIP, uint16(sourcePortInt), port)
-	sentTime := time.Now()
-
-	rawConn.Write(payload)
-	reply := make([]byte, 1514)
-	rawConn.SetReadDeadline(time.Now().Add(2 * time.Second))
-
-	// We only care to see if there was an error or not, what's returned to us
-	// do not matter. Any response at all means a TCP handshake is being attempted.
-	probeResponse := ProbeResponse{TTL: ttl}
-	_, readErr := rawConn.Read(reply)
-	if readErr != nil {
-		lookupKey := fmt.Sprintf("tcp:%s:%s:%d", sourcePortString, target, port)
-		log.Debug("TCP LOOKUP KEY: ", lookupKey)
-		response, lookupErr := lookupResponses(lookupKey)
-		if lookupErr != nil {
-			log.Debug(lookupErr)
-			batch.Add(probeResponse)
-			wg.Done()
-			return
+	ipConn := rawConn.(*net.IPConn)
+	headerIncluded, prepareErr := prepareProbeConn(ipConn, targetIP, ttl, tos)
+	if prepareErr != nil {
+		log.Warn("Error setting up socket towards target: ", prepareErr)
+		return probeResponse
+	}
+	if timestampErr := enableKernelTimestamps(ipConn); timestampErr != nil {
+		log.Debug("Kernel timestamps unavailable for TCP replies: ", timestampErr)
+	}
+	if targetIP.To4() == nil {
+		if hopLimitErr := enableHopLimits(ipConn); hopLimitErr != nil {
+			log.Debug("Hop limits unavailable for TCP replies: ", hopLimitErr)
+		}
+	}
+
+	srcIP := addrIP(rawConn.LocalAddr())
+	seq := uint32(nextProbeID())
+	payload := craftTCPSYNHeader(srcIP, targetIP, sourcePort, port, seq)
+	lookupKey := ProbeKey{Protocol: "tcp", Destination: target, ID: seq}
+	pending := received.Register(lookupKey)
+	defer pending.Cancel()
+
+	scheduler.WaitPacket(target)
+	sent, sentTime, writeErr := writeProbe(ipConn, headerIncluded, srcIP, targetIP, protocolTCP, ttl, tos, false, payload)
+	if writeErr != nil {
+		log.Warn("TCP write failed: ", writeErr)
+		return probeResponse
+	}
+	probeResponse.sentAt = sentTime
+
+	// The target answers us directly on the raw socket while transit hops answer through the
+	// ICMP listener, so wait on both. Closing rawConn on return unblocks the reader.
+	directReply := make(chan tcpReply, 1)
+	go func() {
+		reply := make([]byte, 1514)
+		oob := make([]byte, TIMESTAMP_OOB_SIZE)
+		rawConn.SetReadDeadline(time.Now().Add(PROBE_LOOKUP_TIMEOUT * time.Second))
+
+		// The raw socket sees every TCP segment the target sends us, so only count the ones
+		// acknowledging our SYN. SYN-ACK or RST doesn't matter, either means the target answered.
+		for {
+			segment, _, timestamp, replyTTL, readErr := readTimestamped(ipConn, reply, oob, targetIP.To4() != nil)
+			if readErr != nil {
+				return
+			}
+			if isTCPReplyTo(segment, sourcePort, port, seq) {
+				directReply <- tcpReply{timestamp: timestamp, flags: segment[13], ttl: replyTTL}
+				return
+			}
 		}
+	}()
+
+	timer := time.NewTimer(PROBE_LOOKUP_TIMEOUT * time.Second)
+	defer timer.Stop()
 
+	select {
+	case response := <-pending.Response():
 		rtt := response.Timestamp.Sub(sentTime)
 		probeResponse.IP = null.StringFrom(response.Source.String())
-		probeResponse.Time = rtt.Milliseconds()
-		probeResponse.HeaderSource = response.OriginalHeader.Src
-		probeResponse.HeaderDest = response.OriginalHeader.Dst
+		setRTT(&probeResponse, rtt)
+		probeResponse.setICMPDetails(sent, response)
 		probeResponse.Responded = true
-	} else {
-		rtt := time.Now().Sub(sentTime)
+	case reply := <-directReply:
+		rtt := reply.timestamp.Sub(sentTime)
 		probeResponse.IP = null.StringFrom(target)
-		probeResponse.Time = rtt.Milliseconds()
+		setRTT(&probeResponse, rtt)
+		probeResponse.TCPFlags = null.StringFrom(tcpFlagNames(reply.flags))
+		probeResponse.setReplyTTL(reply.ttl)
 		probeResponse.Responded = true
+	case <-timer.C:
+		log.Debug("Response lookup timed out: ", lookupKey)
 	}
 
-	batch.Add(probeResponse)
-	wg.Done()
+	return probeResponse
+}
+
+// tcpReply is the target answering a SYN probe directly, SYN-ACK or RST
+type tcpReply struct {
+	timestamp time.Time
+	flags     byte
+	ttl       int
+}
+
+// isTCPReplyTo checks whether segment is the target answering the SYN we sent from srcPort
+// to dstPort with sequence number seq.
+func isTCPReplyTo(segment []byte, srcPort, dstPort uint16, seq uint32) bool {
+	if len(segment) < 14 {
+		return false
+	}
+
+	replySrc := binary.BigEndian.Uint16(segment[0:2])
+	replyDst := binary.BigEndian.Uint16(segment[2:4])
+	ack := binary.BigEndian.Uint32(segment[8:12])
+	ackFlag := segment[13]&0x10 != 0
+
+	return replySrc == dstPort && replyDst == srcPort && ackFlag && ack == seq+1
 }
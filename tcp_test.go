@@ -62,9 +62,43 @@ func TestCraftTCPSYNHeader(t *testing.T) {
 		0x92, 0x7e, 0x00, 0x50, 0x00,
 		0x00, 0x00, 0x00, 0x00, 0x00,
 		0x00, 0x00, 0x50, 0x2, 0x00,
-		0x00, 0x00, 0x8f, 0xa0, 0x00,
+		0x00, 0xa0, 0x8f, 0x00, 0x00,
 	}
 
-	testPayload := craftTCPSYNHeader(srcIP, dstIP, uint16(37502), uint16(80))
+	testPayload := craftTCPSYNHeader(srcIP, dstIP, uint16(37502), uint16(80), 0)
 	assert.Equal(expectedPayload, testPayload, "TCP SYN crafted accurately")
 }
+
+func TestCraftTCPSYNHeaderIPv6(t *testing.T) {
+	assert := assert.New(t)
+
+	srcIP := net.ParseIP("2001:db8::1")
+	dstIP := net.ParseIP("2001:db8::2")
+
+	expectedPayload := []byte{
+		0x92, 0x7e, 0x00, 0x50, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x50, 0x2, 0x00,
+		0x00, 0xc1, 0x9f, 0x00, 0x00,
+	}
+
+	testPayload := craftTCPSYNHeader(srcIP, dstIP, uint16(37502), uint16(80), 0)
+	assert.Equal(expectedPayload, testPayload, "TCP SYN crafted accurately")
+}
+
+func TestIsTCPReplyTo(t *testing.T) {
+	assert := assert.New(t)
+
+	synAck := TCPHeader{
+		Source:      80,
+		Destination: 37502,
+		SeqNum:      1000,
+		AckNum:      4243,
+		DataOffset:  5,
+		Ctrl:        0x12,
+	}
+
+	assert.Equal(true, isTCPReplyTo(synAck.Marshal(), 37502, 80, 4242), "SYN-ACK for our probe")
+	assert.Equal(false, isTCPReplyTo(synAck.Marshal(), 37502, 80, 4243), "SYN-ACK for another probe")
+	assert.Equal(false, isTCPReplyTo(synAck.Marshal(), 37503, 80, 4242), "SYN-ACK for another port")
+}
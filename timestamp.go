@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Room for the control messages carrying a receive timestamp
+const TIMESTAMP_OOB_SIZE = 128
+
+// readTimestamped reads one packet along with the time the kernel says it arrived, or the
+// time we got to it if the kernel isn't stamping packets for us. Raw IPv4 sockets hand back
+// the IP header on ReadMsgIP where ReadFrom would have dropped it, so stripIPv4 takes it off
+// again. IPv6 raw sockets never include it.
+//
+// The TTL the packet arrived with comes back too, read from the IPv4 header or from the hop
+// limit the kernel passes along for IPv6 sockets with enableHopLimits. 0 when we can't tell.
+func readTimestamped(conn *net.IPConn, buf []byte, oob []byte, stripIPv4 bool) ([]byte, net.Addr, time.Time, int, error) {
+	n, oobn, _, src, readErr := conn.ReadMsgIP(buf, oob)
+	if readErr != nil {
+		return nil, nil, time.Time{}, 0, readErr
+	}
+	timestamp, ok := kernelTimestamp(oob[:oobn])
+	if !ok {
+		timestamp = time.Now()
+	}
+	replyTTL, _ := kernelHopLimit(oob[:oobn])
+
+	packet := buf[:n]
+	if stripIPv4 && len(packet) > 0 {
+		headerLen := int(packet[0]&0x0f) * 4
+		if headerLen > len(packet) {
+			headerLen = len(packet)
+		}
+		if headerLen > 8 {
+			replyTTL = int(packet[8])
+		}
+		packet = packet[headerLen:]
+	}
+	return packet, src, timestamp, replyTTL, nil
+}
+
+// setRTT fills in the response time in both the original milliseconds and microseconds
+func setRTT(response *ProbeResponse, rtt time.Duration) {
+	response.Time = rtt.Milliseconds()
+	response.TimeMicros = rtt.Microseconds()
+}
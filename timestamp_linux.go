@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// enableKernelTimestamps has the kernel stamp every packet conn receives with the time it
+// came off the wire, well before the scheduler gets around to waking us up.
+func enableKernelTimestamps(conn *net.IPConn) error {
+	rawConn, rawErr := conn.SyscallConn()
+	if rawErr != nil {
+		return rawErr
+	}
+
+	var sockErr error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return sockErr
+}
+
+// enableHopLimits has the kernel pass along the hop limit of every packet an IPv6 socket
+// receives, IPv4 sockets get the whole header instead.
+func enableHopLimits(conn *net.IPConn) error {
+	rawConn, rawErr := conn.SyscallConn()
+	if rawErr != nil {
+		return rawErr
+	}
+
+	var sockErr error
+	controlErr := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return sockErr
+}
+
+// kernelHopLimit pulls the IPV6_HOPLIMIT a packet arrived with out of its control messages
+func kernelHopLimit(oob []byte) (int, bool) {
+	messages, parseErr := syscall.ParseSocketControlMessage(oob)
+	if parseErr != nil {
+		return 0, false
+	}
+
+	for _, message := range messages {
+		if message.Header.Level != syscall.IPPROTO_IPV6 || message.Header.Type != syscall.IPV6_HOPLIMIT {
+			continue
+		}
+		if len(message.Data) < 4 {
+			continue
+		}
+		return int(*(*int32)(unsafe.Pointer(&message.Data[0]))), true
+	}
+	return 0, false
+}
+
+// kernelTimestamp pulls the SCM_TIMESTAMPNS receive time out of a packet's control messages
+func kernelTimestamp(oob []byte) (time.Time, bool) {
+	messages, parseErr := syscall.ParseSocketControlMessage(oob)
+	if parseErr != nil {
+		return time.Time{}, false
+	}
+
+	for _, message := range messages {
+		if message.Header.Level != syscall.SOL_SOCKET || message.Header.Type != syscall.SCM_TIMESTAMPNS {
+			continue
+		}
+		if len(message.Data) < int(unsafe.Sizeof(syscall.Timespec{})) {
+			continue
+		}
+		timespec := (*syscall.Timespec)(unsafe.Pointer(&message.Data[0]))
+		return time.Unix(timespec.Unix()), true
+	}
+	return time.Time{}, false
+}
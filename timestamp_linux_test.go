@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestKernelTimestamp(t *testing.T) {
+	assert := assert.New(t)
+	want := time.Unix(1600000000, 123456789)
+	timespec := syscall.NsecToTimespec(want.UnixNano())
+
+	oob := make([]byte, syscall.CmsgSpace(int(unsafe.Sizeof(timespec))))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = syscall.SOL_SOCKET
+	header.Type = syscall.SCM_TIMESTAMPNS
+	header.SetLen(syscall.CmsgLen(int(unsafe.Sizeof(timespec))))
+	*(*syscall.Timespec)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = timespec
+
+	got, ok := kernelTimestamp(oob)
+	assert.True(ok)
+	assert.True(want.Equal(got), "nanoseconds survive")
+
+	_, ok = kernelTimestamp(nil)
+	assert.False(ok, "no control messages, no timestamp")
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Kernel receive timestamps are only wired up on linux, everywhere else packets get stamped
+// once we've read them.
+func enableKernelTimestamps(conn *net.IPConn) error {
+	return fmt.Errorf("kernel timestamps not supported on this platform")
+}
+
+func kernelTimestamp(oob []byte) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func enableHopLimits(conn *net.IPConn) error {
+	return fmt.Errorf("IPv6 hop limits not supported on this platform")
+}
+
+func kernelHopLimit(oob []byte) (int, bool) {
+	return 0, false
+}
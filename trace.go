@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const TRACE_DEFAULT_TCP_PORT = 80
+
+// runTrace is the trace subcommand. It runs one probe in the foreground exactly the way the
+// agent would for a target with the same settings, and prints the result instead of sending it
+// anywhere. Returns the exit code.
+func runTrace(args []string) int {
+	flags := flag.NewFlagSet("trace", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: voyager-probe trace [flags] host")
+		flags.PrintDefaults()
+	}
+	probeType := flags.String("type", "udp", "probe type: tcp, udp, icmp or pmtu")
+	port := flags.Uint("port", 0, "destination port for tcp (default 80) and for udp with -paris, -mda or pmtu (default 33434), plain udp always counts up from 33434")
+	count := flags.Int("count", DEFAULT_PROBE_COUNT, "probes per TTL")
+	maxHops := flags.Int("max-hops", MAX_HOPS, "highest TTL to probe")
+	family := flags.String("family", FAMILY_ANY, "address family to resolve host to: ipv4 or ipv6")
+	allAddresses := flags.Bool("all", false, "trace to every address host resolves to")
+	index := flags.Int("index", 0, "trace to this address of the ones host resolves to, counting from 0")
+	dscp := flags.Int("dscp", 0, "DSCP to mark probes with, 0-63")
+	ecn := flags.Int("ecn", 0, "ECN bits to mark probes with, 0-3")
+	paris := flags.Bool("paris", false, "keep the flow constant across the whole trace")
+	mda := flags.Bool("mda", false, "enumerate every load balanced path")
+	noDNS := flags.Bool("n", false, "skip reverse DNS lookups")
+	resolver := flags.String("resolver", "", "send reverse DNS lookups to this resolver (host:port)")
+	jsonOutput := flags.Bool("json", false, "print the result as JSON instead of a table")
+	debugLog := flags.Bool("d", false, "debug")
+
+	// Flags are allowed on either side of the host
+	if parseErr := flags.Parse(args); parseErr != nil {
+		return 2
+	}
+	host := flags.Arg(0)
+	if flags.NArg() > 1 {
+		if parseErr := flags.Parse(flags.Args()[1:]); parseErr != nil {
+			return 2
+		}
+		if flags.NArg() > 0 {
+			flags.Usage()
+			return 2
+		}
+	}
+	if host == "" {
+		flags.Usage()
+		return 2
+	}
+
+	if _, ok := probeTypeMap[*probeType]; !ok {
+		fmt.Fprintf(os.Stderr, "unsupported type: %s\n", *probeType)
+		return 2
+	}
+	if *port > 65535 {
+		fmt.Fprintf(os.Stderr, "invalid port: %d\n", *port)
+		return 2
+	}
+	if *index < 0 {
+		fmt.Fprintf(os.Stderr, "invalid index: %d\n", *index)
+		return 2
+	}
+	if *dscp < 0 || *dscp > 63 {
+		fmt.Fprintf(os.Stderr, "invalid dscp: %d\n", *dscp)
+		return 2
+	}
+	if *ecn < 0 || *ecn > 3 {
+		fmt.Fprintf(os.Stderr, "invalid ecn: %d\n", *ecn)
+		return 2
+	}
+	if *port == 0 && *probeType == "tcp" {
+		*port = TRACE_DEFAULT_TCP_PORT
+	}
+
+	// Only warnings and up by default, the table is what the user asked for
+	log.SetLevel(log.WarnLevel)
+	if *debugLog {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	target := ProbeTarget{
+		Destination:   host,
+		Type:          *probeType,
+		Port:          uint16(*port),
+		ProbeCount:    *count,
+		MaxHops:       *maxHops,
+		AddressFamily: *family,
+		Paris:         *paris,
+		MDA:           *mda,
+		AllAddresses:  *allAddresses,
+		AddressIndex:  *index,
+		DSCP:          *dscp,
+		ECN:           *ecn,
+	}
+
+	addresses, addrErr := targetAddresses(target)
+	if addrErr != nil {
+		fmt.Fprintln(os.Stderr, addrErr)
+		return 1
+	}
+	if !*noDNS {
+		rdnsCache = NewDNSCache(RDNS_DEFAULT_TTL, RDNS_DEFAULT_NEGATIVE_TTL, RDNS_DEFAULT_TIMEOUT, RDNS_DEFAULT_CONCURRENCY, *resolver)
+	}
+
+	startICMPListener()
+	probes := make([]Probe, 0, len(addresses))
+	for _, address := range addresses {
+		probe, probeErr := runProbe(target, address)
+		if probeErr != nil {
+			fmt.Fprintln(os.Stderr, probeErr)
+			return 1
+		}
+		if !*noDNS {
+			resolveHopNames(probe.Hops)
+		}
+		probe.EndTime = time.Now()
+		probes = append(probes, probe)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		// A list only when asked for every address, a single trace prints the same as before
+		if *allAddresses {
+			encoder.Encode(probes)
+		} else {
+			encoder.Encode(probes[0])
+		}
+		return 0
+	}
+
+	for i, probe := range probes {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s trace to %s (%s), %d hops max\n", target.Type, target.Destination, probe.ResolvedIP, target.maxHops())
+		writeTraceTable(os.Stdout, probe)
+		if probe.PMTU != nil {
+			fmt.Println()
+			writePMTUTable(os.Stdout, probe.PMTU)
+		}
+	}
+	return 0
+}
+
+// writeTraceTable prints one row per address seen at every TTL, the best guess first. RTTs are
+// in milliseconds. Addresses that told us the destination is unreachable get the same !H, !X
+// and so on classic traceroute prints.
+func writeTraceTable(out io.Writer, probe Probe) {
+	names := make(map[string]string)
+	addresses := make(map[string]string)
+	for _, hop := range probe.Hops {
+		if hop.DNSName.Valid {
+			names[hop.IP.String] = hop.DNSName.String
+		}
+		if _, ok := addresses[hop.IP.String]; !ok {
+			addresses[hop.IP.String] = hop.IP.String
+		}
+		if hop.Unreachable.Valid {
+			addresses[hop.IP.String] = hop.IP.String + " " + unreachableMarkers[hop.Unreachable.String]
+		}
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TTL\tADDRESS\tNAME\tLOSS\tSENT\tLAST\tAVG\tBEST\tWORST\tSTDEV")
+	for _, hop := range probe.Summary {
+		if hop.Received == 0 {
+			fmt.Fprintf(table, "%d\t*\t\t%.1f%%\t%d\t\t\t\t\t\n", hop.TTL, hop.Loss, hop.Sent)
+			continue
+		}
+
+		fmt.Fprintf(table, "%d\t%s\t%s\t%.1f%%\t%d\t%s\t%s\t%s\t%s\t%s\n", hop.TTL, addresses[hop.Address.String],
+			names[hop.Address.String], hop.Loss, hop.Sent, formatRTT(hop.RTTLast.Float64),
+			formatRTT(hop.RTTAvg.Float64), formatRTT(hop.RTTMin.Float64), formatRTT(hop.RTTMax.Float64),
+			formatRTT(hop.RTTStdDev.Float64))
+		for _, address := range hop.Addresses {
+			if address != hop.Address.String {
+				fmt.Fprintf(table, "\t%s\t%s\t\t\t\t\t\t\t\n", addresses[address], names[address])
+			}
+		}
+	}
+	table.Flush()
+}
+
+// writePMTUTable prints the MTU found at every TTL and the path MTU under it. Hops bigger
+// probes vanished on the way to are marked black hole.
+func writePMTUTable(out io.Writer, result *PMTUResult) {
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TTL\tADDRESS\tMTU\tNEXT HOP MTU\t")
+	for _, hop := range result.Hops {
+		address, mtu, nextHop, blackHole := "*", "", "", ""
+		if hop.IP.Valid {
+			address = hop.IP.String
+		}
+		if hop.MTU.Valid {
+			mtu = fmt.Sprint(hop.MTU.Int64)
+		}
+		if hop.NextHopMTU.Valid {
+			nextHop = fmt.Sprint(hop.NextHopMTU.Int64)
+		}
+		if hop.BlackHole {
+			blackHole = "black hole"
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\n", hop.TTL, address, mtu, nextHop, blackHole)
+	}
+	table.Flush()
+
+	if result.PathMTU.Valid {
+		fmt.Fprintf(out, "path MTU %d\n", result.PathMTU.Int64)
+	} else {
+		fmt.Fprintln(out, "path MTU unknown, destination not reached")
+	}
+}
+
+func formatRTT(rtt float64) string {
+	return fmt.Sprintf("%.3f", rtt)
+}
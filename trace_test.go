@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"strings"
+	"testing"
+)
+
+func TestWriteTraceTable(t *testing.T) {
+	assert := assert.New(t)
+	hops := []ProbeResponse{
+		{TTL: 1, Responded: true, IP: null.StringFrom("10.0.0.1"), DNSName: null.StringFrom("gw.example.net"), TimeMicros: 1500},
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.1.1"), TimeMicros: 2000},
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.1.2"), TimeMicros: 2500},
+		{TTL: 2, Responded: true, IP: null.StringFrom("10.0.1.1"), TimeMicros: 3000},
+		{TTL: 3},
+	}
+
+	var out bytes.Buffer
+	writeTraceTable(&out, Probe{Hops: hops, Summary: summarizeHops(hops)})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	assert.Equal(5, len(lines))
+	assert.Equal([]string{"1", "10.0.0.1", "gw.example.net", "0.0%", "1", "1.500", "1.500", "1.500", "1.500", "0.000"}, strings.Fields(lines[1]))
+	assert.Equal("10.0.1.1", strings.Fields(lines[2])[1], "best guess first")
+	assert.Equal([]string{"10.0.1.2"}, strings.Fields(lines[3]), "other addresses listed under it")
+	assert.Equal([]string{"3", "*", "100.0%", "1"}, strings.Fields(lines[4]))
+}
+
+func TestRunTraceRejectsBadArguments(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(2, runTrace([]string{}), "host required")
+	assert.Equal(2, runTrace([]string{"-type", "sctp", "192.0.2.1"}))
+	assert.Equal(2, runTrace([]string{"192.0.2.1", "192.0.2.2"}), "one host at a time")
+}
@@ -1,13 +1,10 @@
 package main
 
 import (
-	"fmt"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/ipv4"
 	"gopkg.in/guregu/null.v4"
 	"net"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 )
 
@@ -15,84 +12,146 @@ func NewUDPProbeExecutor(target ProbeTarget) ProbeExecutor {
 	return &UDPProbeExecutor{target}
 }
 
+// First destination port used by classic traceroute
+const UDP_BASE_PORT = 33434
+
 type UDPProbeExecutor struct {
 	ProbeTarget
 }
 
 func (u *UDPProbeExecutor) Execute(target string, port uint16, count int) ([]ProbeResponse, error) {
+	targetIP, addrErr := resolveTarget(target, u.AddressFamily)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+	target = targetIP.String()
+
 	log.Info("Starting UDP probes to ", target)
 
-	// TODO: a lot of this is repetitive with TCP impl. could we abstract this away and accept a
-	// callable instead?
-	currentTTL := 1
-	hops := make([]ProbeResponse, 0)
-	for currentTTL <= MAX_HOPS {
-		var probewg sync.WaitGroup
-		probewg.Add(count)
-		batch := ProbeBatch{hops: make([]ProbeResponse, 0, count)}
-		startingPort := uint16(33434)
-		for i := 0; i < count; i++ {
-			// here
-			go sendUDPProbe(&probewg, &batch, target, startingPort, currentTTL)
-			startingPort++
+	var sender hopSender
+	if u.Paris {
+		// Paris mode pins every probe to a single flow so the flow hash never changes, probes
+		// are told apart by their checksum alone.
+		send, closeFlows, flowErr := u.OpenFlows(targetIP, port)
+		if flowErr != nil {
+			return nil, flowErr
 		}
-		probewg.Wait()
+		defer closeFlows()
 
-		hops = append(hops, batch.hops...)
-		currentTTL++
-		if batch.IsFinal(target) {
-			break
+		sender = func(ttl int, attempt int) ProbeResponse {
+			return send(ttl, 0)
+		}
+	} else {
+		// Classic traceroute behavior, every probe within a TTL batch targets the next port up
+		sender = func(ttl int, attempt int) ProbeResponse {
+			dstPort := uint16(UDP_BASE_PORT + attempt)
+			source, reserveErr := reserveUDPPort(targetIP, dstPort)
+			if reserveErr != nil {
+				log.Warn("UDP Dialer failed: ", reserveErr)
+				return ProbeResponse{TTL: ttl}
+			}
+			defer source.Close()
+
+			return sendUDPProbe(targetIP, source.LocalAddr().(*net.UDPAddr), dstPort, ttl, u.tos())
 		}
 	}
 
+	hops := traceHops(target, count, u.maxHops(), sender)
+
 	log.Debug("probe complete to ", target)
 	return hops, nil
 }
 
-func sendUDPProbe(wg *sync.WaitGroup, batch *ProbeBatch, target string, port uint16, ttl int) {
-	dst := fmt.Sprintf("%s:%d", target, port)
+// OpenFlows implements FlowProber. Every flow shares one reserved source port and gets its
+// own destination port counting up from the target port, or UDP_BASE_PORT if none was set.
+func (u *UDPProbeExecutor) OpenFlows(targetIP net.IP, port uint16) (flowSender, func(), error) {
+	if port == 0 {
+		port = UDP_BASE_PORT
+	}
+	source, reserveErr := reserveUDPPort(targetIP, port)
+	if reserveErr != nil {
+		return nil, nil, reserveErr
+	}
 
-	dialerConn, dialConnErr := net.Dial("udp", dst)
-	if dialConnErr != nil {
-		log.Warn("UDP Dialer failed: ", dialConnErr)
-		return
+	sourceAddr := source.LocalAddr().(*net.UDPAddr)
+	send := func(ttl int, flow int) ProbeResponse {
+		response := sendUDPProbe(targetIP, sourceAddr, port+uint16(flow), ttl, u.tos())
+		response.FlowID = null.IntFrom(int64(flow))
+		return response
 	}
+	return send, func() { source.Close() }, nil
+}
 
-	packetConn := ipv4.NewConn(dialerConn)
-	packetConn.SetTTL(ttl)
+// reserveUDPPort connects a regular UDP socket towards the target so the OS reserves a source
+// port and picks the source address for us. The probes themselves go out a raw socket so the
+// checksum we craft is exactly what hits the wire, no matter what checksum offload would have
+// done with it.
+func reserveUDPPort(targetIP net.IP, port uint16) (net.Conn, error) {
+	dst := net.JoinHostPort(targetIP.String(), strconv.Itoa(int(port)))
+	return net.Dial("udp", dst)
+}
 
-	sentTime := time.Now()
-	_, writeErr := dialerConn.Write([]byte("test"))
-	if writeErr != nil {
-		panic(writeErr)
-	}
+func sendUDPProbe(targetIP net.IP, source *net.UDPAddr, port uint16, ttl int, tos int) ProbeResponse {
+	return sendSizedUDPProbe(targetIP, source, port, ttl, tos, 0)
+}
+
+// sendSizedUDPProbe sends a UDP probe padded out to size bytes, IP header included, that
+// nothing along the way is allowed to fragment. A size of 0 is the smallest probe we can send,
+// which goes out the way any other would.
+func sendSizedUDPProbe(targetIP net.IP, source *net.UDPAddr, port uint16, ttl int, tos int, size int) ProbeResponse {
+	// Counts against -concurrency from the socket being opened until the answer or timeout
+	release := scheduler.StartProbe()
+	defer release()
 
 	probeResponse := ProbeResponse{TTL: ttl}
+	target := targetIP.String()
 
-	srcPort := strings.Split(dialerConn.LocalAddr().String(), ":")[1]
-	lookupKey := fmt.Sprintf("udp:%s:%s:%d", srcPort, target, port)
-	response, lookupErr := lookupResponses(lookupKey)
-	if lookupErr != nil {
-		log.Debug(lookupErr)
+	rawConn, rawErr := net.Dial(rawNetwork(targetIP, "udp"), target)
+	if rawErr != nil {
+		log.Warn("Error creating socket towards target: ", rawErr)
+		return probeResponse
+	}
+	defer rawConn.Close()
+	ipConn := rawConn.(*net.IPConn)
+	headerIncluded, prepareErr := prepareProbeConn(ipConn, targetIP, ttl, tos)
+	if prepareErr != nil {
+		log.Warn("Error setting up socket towards target: ", prepareErr)
+		return probeResponse
+	}
+	if size > 0 {
+		if pmtuErr := enablePMTUProbing(ipConn, targetIP); pmtuErr != nil {
+			log.Warn("Can't keep probe from being fragmented: ", pmtuErr)
+			return probeResponse
+		}
+		probeResponse.Size = null.IntFrom(int64(size))
+	}
 
-		batch.Add(probeResponse)
+	id := nextProbeID()
+	datagram := craftPaddedUDPDatagram(source.IP, targetIP, uint16(source.Port), port, id, size-ipHeaderLen(targetIP))
+	lookupKey := ProbeKey{Protocol: "udp", Destination: target, ID: uint32(id)}
+	pending := received.Register(lookupKey)
 
-		// using defer was leaking sockets but explicitly closing them is not
-		dialerConn.Close()
-		wg.Done()
-		return
+	scheduler.WaitPacket(target)
+	sent, sentTime, writeErr := writeProbe(ipConn, headerIncluded, source.IP, targetIP, protocolUDP, ttl, tos, size > 0, datagram)
+	if writeErr != nil {
+		log.Warn("UDP write failed: ", writeErr)
+		pending.Cancel()
+		return probeResponse
 	}
+	probeResponse.sentAt = sentTime
 
-	dialerConn.Close()
+	response, lookupErr := pending.Wait(PROBE_LOOKUP_TIMEOUT * time.Second)
+	if lookupErr != nil {
+		log.Debug(lookupErr)
+		return probeResponse
+	}
 
-	// FOR TESTING ONLY
+	// The listener timestamps responses as the kernel received them
 	rtt := response.Timestamp.Sub(sentTime)
 	probeResponse.IP = null.StringFrom(response.Source.String())
-	probeResponse.Time = rtt.Milliseconds()
-	probeResponse.HeaderSource = response.OriginalHeader.Src
-	probeResponse.HeaderDest = response.OriginalHeader.Dst
+	setRTT(&probeResponse, rtt)
+	probeResponse.setICMPDetails(sent, response)
 	probeResponse.Responded = true
 
-	batch.Add(probeResponse)
-	wg.Done()
+	return probeResponse
 }